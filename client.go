@@ -0,0 +1,329 @@
+package main
+
+/*
+## A reusable client
+
+The client function below writes commands and payloads by hand. For real
+programs, Client wraps a connection opened through Open and takes care of
+the details: it encodes the request, sends it as a frame, flushes the
+buffer, waits for the reply, and decodes it.
+
+Client speaks the framed protocol, so the endpoint must use WithFraming.
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrClientClosed is returned by calls on a closed Client.
+var ErrClientClosed = errors.New("client closed")
+
+// Client sends requests to a framed endpoint. It is safe for concurrent
+// use; concurrent calls are sent one after the other, unless the Client
+// is created WithMultiplexing.
+type Client struct {
+	name      string
+	addr      string
+	tlsConfig *tls.Config
+	// dial replaces TCP and Unix sockets if set WithDialer. See
+	// memory.go.
+	dial func(addr string) (net.Conn, error)
+	// codec is nil for the endpoint's default codec, which is assumed
+	// to be GOB.
+	codec Codec
+
+	// mu serializes requests, so that each reply belongs to the
+	// request that was sent last.
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	// err is set when the connection cannot be used anymore.
+	err error
+
+	// peer is the endpoint's Hello from the last handshake.
+	peer Hello
+
+	// closing is closed by Close to interrupt a pending call.
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// reconnect is nil unless the Client was created WithReconnect.
+	// rnd adds jitter to the backoff delays.
+	reconnect *ReconnectPolicy
+	rnd       *rand.Rand
+
+	// streams are the persistent encoder and decoder of the current
+	// connection. See stream.go.
+	streams clientStreams
+
+	// multiplexed is set WithMultiplexing. mux tracks the pending calls
+	// on the current connection, and nextID is the last request ID.
+	// See mux.go.
+	multiplexed bool
+	mux         *muxConn
+	nextID      uint32
+
+	// logger receives the Client's log records. See logging.go.
+	logger *slog.Logger
+}
+
+// NewClient opens a connection to the endpoint at addr. The first dial is
+// not retried, even if WithReconnect is set.
+func NewClient(addr string, opts ...ClientOption) (*Client, error) {
+	return newClient(context.Background(), addr, opts...)
+}
+
+// newClient works like NewClient but gives up dialing and the handshake
+// when ctx ends.
+func newClient(ctx context.Context, addr string, opts ...ClientOption) (*Client, error) {
+	c := &Client{addr: addr, closing: make(chan struct{}), logger: discardLogger}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect opens a new connection, exchanges Hellos, and starts reading
+// replies if the Client is multiplexed. It gives up when ctx ends or the
+// Client is closed. c.mu must be held, or c must not be shared yet.
+func (c *Client) connect(ctx context.Context) error {
+	conn, rw, err := c.open(ctx)
+	if err != nil {
+		return err
+	}
+	c.conn, c.rw, c.err = conn, rw, nil
+	c.streams = clientStreams{}
+	stop := watchContext(ctx, c.closing, conn)
+	err = c.handshake()
+	stop()
+	if err != nil {
+		conn.Close()
+		c.err = err
+		return err
+	}
+	// Remove the handshake's deadline, which would otherwise apply to
+	// the goroutine that reads multiplexed replies.
+	conn.SetDeadline(time.Time{})
+	if c.multiplexed {
+		c.startMux()
+	}
+	return nil
+}
+
+// Call sends a request and decodes the reply into resp.
+//
+// A []byte or string request is sent as is, and any other value is
+// encoded with the Client's codec (GOB by default). Likewise, resp can be
+// a *[]byte or *string to receive the raw reply, a pointer to a value to
+// decode the reply into, or nil to ignore the reply. If the endpoint
+// replies with an error, Call returns a *RemoteError.
+func (c *Client) Call(ctx context.Context, cmd string, req, resp interface{}) error {
+	return c.roundTrip(ctx, cmd, 0,
+		func() ([]byte, error) { return c.encodePayload(req) },
+		func(reply []byte) error { return c.decodePayload(reply, resp) })
+}
+
+// Send sends a request without waiting for a reply. The endpoint does
+// not send one, not even if the handler fails.
+func (c *Client) Send(ctx context.Context, cmd string, req interface{}) error {
+	return c.roundTrip(ctx, cmd, FlagOneWay,
+		func() ([]byte, error) { return c.encodePayload(req) }, nil)
+}
+
+// Close closes the connection. Pending and future calls fail with
+// ErrClientClosed.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.err == nil {
+			err = c.conn.Close()
+		}
+		c.err = ErrClientClosed
+	})
+	return err
+}
+
+// roundTrip sends a request frame and, unless it is one-way, reads the
+// reply frame. encode builds the request payload, and decode processes
+// the reply payload. Both run while c.mu is held, so that the persistent
+// encoder and decoder see the payloads in the order they travel.
+//
+// If the exchange fails halfway, the connection is out of sync and gets
+// closed. With a reconnect policy, roundTrip redials broken connections
+// and resends idempotent requests once, calling encode again.
+func (c *Client) roundTrip(ctx context.Context, cmd string, flags byte, encode func() ([]byte, error), decode func([]byte) error) error {
+	if c.multiplexed {
+		return c.muxRoundTrip(ctx, cmd, flags, encode, decode)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if err := c.ensureConn(ctx); err != nil {
+			return err
+		}
+		payload, err := encode()
+		if err != nil {
+			c.resetStreams()
+			return err
+		}
+		f := Frame{Flags: flags, Command: cmd, Payload: payload}
+		if c.streams.reset {
+			f.Flags |= FlagReset
+			c.streams.reset = false
+		}
+		stop := watchContext(ctx, c.closing, c.conn)
+		reply, err := c.exchange(f)
+		stop()
+		if err == nil {
+			return c.handleReply(f, reply, decode)
+		}
+
+		select {
+		case <-c.closing:
+			return ErrClientClosed
+		default:
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		c.err = errors.Wrap(err, "Connection to "+c.addr+" is broken")
+		c.conn.Close()
+		if ctx.Err() != nil || attempt > 0 || c.reconnect == nil || !c.reconnect.idempotent(cmd) {
+			return err
+		}
+		c.logger.Info("Resend idempotent request", "command", cmd)
+	}
+}
+
+// handleReply passes the reply to request f to decode, or returns the
+// error reply as a *RemoteError. c.mu must be held.
+func (c *Client) handleReply(f, reply Frame, decode func([]byte) error) error {
+	if f.Flags&FlagOneWay != 0 {
+		// The endpoint may not have decoded the request, and with it
+		// the type descriptions it carried.
+		c.resetStreams()
+		return nil
+	}
+	if reply.Flags&FlagReset != 0 {
+		c.streams.dec = nil
+	}
+	if err := reply.Err(); err != nil {
+		var rerr *RemoteError
+		if errors.As(err, &rerr) && rerr.Code.closesConnection() {
+			// The endpoint closes the connection after this reply.
+			// It may even have sent it before the request arrived,
+			// as with an idle timeout.
+			c.err = errors.Wrap(err, "Connection to "+c.addr+" is broken")
+			c.conn.Close()
+			return err
+		}
+		// The endpoint may not have decoded the whole request.
+		c.resetStreams()
+		return err
+	}
+	if decode == nil {
+		return nil
+	}
+	if err := decode(reply.Payload); err != nil {
+		c.resetStreams()
+		return err
+	}
+	return nil
+}
+
+// exchange writes f and reads the reply.
+func (c *Client) exchange(f Frame) (Frame, error) {
+	if err := WriteFrame(c.rw, f); err != nil {
+		return Frame{}, errors.Wrap(err, "Could not send the "+f.Command+" request")
+	}
+	if err := c.rw.Flush(); err != nil {
+		return Frame{}, errors.Wrap(err, "Flush failed.")
+	}
+	if f.Flags&FlagOneWay != 0 {
+		return Frame{}, nil
+	}
+	reply, err := ReadFrame(c.rw)
+	if err != nil {
+		return Frame{}, errors.Wrap(err, "Failed to read the reply to "+f.Command)
+	}
+	return reply, nil
+}
+
+// watchContext applies the deadline of ctx to conn and interrupts
+// pending reads and writes when ctx is cancelled or closing is closed.
+// The returned function stops watching.
+func watchContext(ctx context.Context, closing <-chan struct{}, conn net.Conn) (stop func()) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+		case <-closing:
+		case <-done:
+			return
+		}
+		// A deadline in the past unblocks all pending I/O.
+		conn.SetDeadline(time.Unix(1, 0))
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// encodePayload turns a request value into a frame payload. c.mu must
+// be held.
+func (c *Client) encodePayload(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return c.encode(v)
+}
+
+// decodePayload stores a reply payload in v. c.mu must be held, unless
+// the Client is multiplexed.
+func (c *Client) decodePayload(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*v = data
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	}
+	return c.decode(data, v)
+}
+
+// getCodec returns the Client's codec.
+func (c *Client) getCodec() Codec {
+	if c.codec == nil {
+		return GobCodec{}
+	}
+	return c.codec
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TestClientIdleTimeout checks that a Client that finds the endpoint's
+// idle timeout reply in place of a reply stops using the connection.
+func TestClientIdleTimeout(t *testing.T) {
+	e := serverEndpoint(WithFraming(), WithIdleTimeout(20*time.Millisecond))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Serve(l)
+	defer e.Shutdown(context.Background())
+
+	c, err := NewClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		err := c.Call(context.Background(), "STRING", "hello\n", nil)
+		var rerr *RemoteError
+		if !errors.As(err, &rerr) || rerr.Code != StatusTimeout {
+			t.Fatalf("Call %d returned %v, want StatusTimeout", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+/*
+## Codecs
+
+GOB is great between Go programs, but other languages cannot read it. A Codec
+turns values into bytes and back. The endpoint ships with GOB (the default)
+and JSON, and RegisterCodec adds more.
+
+Which codec a handler should use is decided per connection or per command:
+
+* A client can switch its connection to another codec by sending the CODEC
+  command with the codec name as a line of payload, for example
+  `CODEC\njson\n`. The endpoint confirms with the codec name.
+* A command that is registered WithCommandCodec always uses that codec.
+
+Handlers ask CodecFromContext for the codec to use.
+
+JSON values travel as single lines ("JSON Lines"), so that a decoder never
+reads past the end of its value - in newline mode, the next command follows
+right after the payload.
+*/
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// codecCommand is the built-in command for switching a connection's codec.
+const codecCommand = "CODEC"
+
+// Codec creates encoders and decoders for a data format.
+type Codec interface {
+	// Name identifies the codec during negotiation.
+	Name() string
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// Encoder writes values to a stream.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder reads values from a stream.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// GobCodec encodes values as GOB.
+type GobCodec struct{}
+
+// Name returns "gob".
+func (GobCodec) Name() string { return "gob" }
+
+// NewEncoder returns a gob.Encoder.
+func (GobCodec) NewEncoder(w io.Writer) Encoder { return gob.NewEncoder(w) }
+
+// NewDecoder returns a gob.Decoder.
+func (GobCodec) NewDecoder(r io.Reader) Decoder { return gob.NewDecoder(r) }
+
+// JSONCodec encodes values as JSON, one value per line.
+type JSONCodec struct{}
+
+// Name returns "json".
+func (JSONCodec) Name() string { return "json" }
+
+// NewEncoder returns a json.Encoder, which terminates each value with
+// a newline.
+func (JSONCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+
+// NewDecoder returns a decoder that reads one line per value.
+func (JSONCodec) NewDecoder(r io.Reader) Decoder {
+	switch r := r.(type) {
+	case *bufio.Reader:
+		return jsonLineDecoder{r}
+	case *bufio.ReadWriter:
+		return jsonLineDecoder{r.Reader}
+	}
+	return jsonLineDecoder{bufio.NewReader(r)}
+}
+
+// jsonLineDecoder decodes a JSON value from the next line.
+type jsonLineDecoder struct {
+	r *bufio.Reader
+}
+
+func (d jsonLineDecoder) Decode(v interface{}) error {
+	line, err := d.r.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"gob":  GobCodec{},
+		"json": JSONCodec{},
+	}
+)
+
+// RegisterCodec makes a codec available for negotiation by its name.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	codecs[c.Name()] = c
+	codecsMu.Unlock()
+}
+
+// lookupCodec returns the registered codec with the given name.
+func lookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// WithDefaultCodec sets the codec for connections that do not negotiate
+// one. The default is GobCodec.
+func WithDefaultCodec(c Codec) Option {
+	return func(e *Endpoint) {
+		e.codec = c
+	}
+}
+
+// WithCommandCodec makes a command always use the given codec,
+// whatever the connection has negotiated.
+func WithCommandCodec(c Codec) HandlerOption {
+	return func(cmd *command) {
+		cmd.codec = c
+	}
+}
+
+// WithClientCodec makes the Client encode requests and decode replies
+// with the given codec. The Client negotiates it with the endpoint on
+// each new connection.
+func WithClientCodec(c Codec) ClientOption {
+	return func(cl *Client) {
+		cl.codec = c
+	}
+}
+
+// codecKey is the context key for the codec of the current command.
+type codecKey struct{}
+
+// CodecFromContext returns the codec that a handler should use for
+// decoding its request and encoding its reply.
+func CodecFromContext(ctx context.Context) Codec {
+	if c, ok := ctx.Value(codecKey{}).(Codec); ok {
+		return c
+	}
+	return GobCodec{}
+}
+
+// handleCodec handles the CODEC command. It switches the connection
+// to the codec named in the payload line.
+func handleCodec(ctx context.Context, rw *bufio.ReadWriter) error {
+	name, err := rw.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "Cannot read codec name")
+	}
+	name = strings.TrimSpace(name)
+	c, ok := lookupCodec(name)
+	if !ok {
+		return &RemoteError{Code: StatusUnsupported, Message: "unknown codec " + name}
+	}
+	sessionFromContext(ctx).setCodec(c)
+	if _, err := rw.WriteString(c.Name() + "\n"); err != nil {
+		return errors.Wrap(err, "Cannot write to connection.")
+	}
+	return errors.Wrap(rw.Flush(), "Flush failed.")
+}
+
+// negotiateCodec asks the endpoint to switch the connection to the
+// Client's codec. c.mu must be held, or c must not be shared yet.
+func (c *Client) negotiateCodec() error {
+	if c.codec == nil {
+		return nil
+	}
+	reply, err := c.exchange(Frame{Command: codecCommand, Payload: []byte(c.codec.Name() + "\n")})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(reply.Err(), "Codec negotiation failed")
+}
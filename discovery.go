@@ -0,0 +1,224 @@
+package main
+
+/*
+## Discovery
+
+Which commands does an endpoint offer, and what do they expect? Two
+built-in commands answer this:
+
+* LIST replies with the names of all registered commands.
+* HELP replies with the name, description, and request and reply types of
+  all commands, or of the command named in its payload line.
+
+Both reply with a single line of JSON, like HELLO. In newline mode, HELP
+always reads a payload line, which may be empty:
+
+    HELP\n\n
+    HELP\nECHO\n
+
+Descriptions and types are given at registration time, through the
+WithDescription and WithTypes options. Handle adds the types by itself.
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Built-in commands for discovery.
+const (
+	listCommand = "LIST"
+	helpCommand = "HELP"
+)
+
+// CommandInfo describes a registered command.
+type CommandInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Request and Response describe the Go types of the request and
+	// the reply, if known.
+	Request  string `json:"request,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+// WithDescription adds a description to a command, for HELP.
+func WithDescription(text string) HandlerOption {
+	return func(cmd *command) {
+		cmd.info.Description = text
+	}
+}
+
+// WithTypes tells HELP the types of a command's request and reply,
+// given as sample values. A nil value means that the type is unknown.
+func WithTypes(req, resp interface{}) HandlerOption {
+	return withTypes(reflect.TypeOf(req), reflect.TypeOf(resp))
+}
+
+func withTypes(req, resp reflect.Type) HandlerOption {
+	return func(cmd *command) {
+		cmd.info.Request = describeType(req)
+		cmd.info.Response = describeType(resp)
+	}
+}
+
+// describeType renders a type in Go syntax. For a struct, or a pointer
+// to one, it lists the exported fields, so that clients in other
+// languages know what to send.
+func describeType(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	s := t
+	prefix := ""
+	for s.Kind() == reflect.Ptr {
+		s = s.Elem()
+		prefix += "*"
+	}
+	if s.Kind() != reflect.Struct {
+		return t.String()
+	}
+	var fields []string
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fields = append(fields, f.Name+" "+f.Type.String())
+	}
+	return fmt.Sprintf("%s%s struct { %s }", prefix, s.String(), strings.Join(fields, "; "))
+}
+
+// commandInfos returns the descriptions of all registered commands,
+// sorted by name.
+func (e *Endpoint) commandInfos() []CommandInfo {
+	e.m.RLock()
+	infos := make([]CommandInfo, 0, len(e.handler))
+	for name, cmd := range e.handler {
+		info := cmd.info
+		info.Name = name
+		infos = append(infos, info)
+	}
+	e.m.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// handleList handles the LIST command.
+func (e *Endpoint) handleList(ctx context.Context, rw *bufio.ReadWriter) error {
+	infos := e.commandInfos()
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name
+	}
+	return writeJSONLine(rw, names)
+}
+
+// handleHelp handles the HELP command.
+func (e *Endpoint) handleHelp(ctx context.Context, rw *bufio.ReadWriter) error {
+	name, err := rw.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "Cannot read command name")
+	}
+	name = strings.TrimSpace(name)
+	infos := e.commandInfos()
+	if name == "" {
+		return writeJSONLine(rw, infos)
+	}
+	for _, info := range infos {
+		if info.Name == name {
+			return writeJSONLine(rw, []CommandInfo{info})
+		}
+	}
+	return &RemoteError{Code: StatusUnknownCommand, Message: "command " + name + " is not registered"}
+}
+
+// writeJSONLine writes v as a line of JSON and flushes it.
+func writeJSONLine(rw *bufio.ReadWriter, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot encode %T", v)
+	}
+	if _, err := rw.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "Cannot write to connection.")
+	}
+	return errors.Wrap(rw.Flush(), "Flush failed.")
+}
+
+// List returns the names of the commands that the endpoint offers.
+func (c *Client) List(ctx context.Context) ([]string, error) {
+	var reply []byte
+	if err := c.Call(ctx, listCommand, nil, &reply); err != nil {
+		return nil, err
+	}
+	var names []string
+	return names, errors.Wrap(json.Unmarshal(reply, &names), "Cannot parse the LIST reply")
+}
+
+// Help describes the command with the given name, or all commands if
+// name is empty.
+func (c *Client) Help(ctx context.Context, name string) ([]CommandInfo, error) {
+	var reply []byte
+	if err := c.Call(ctx, helpCommand, name+"\n", &reply); err != nil {
+		return nil, err
+	}
+	var infos []CommandInfo
+	return infos, errors.Wrap(json.Unmarshal(reply, &infos), "Cannot parse the HELP reply")
+}
+
+// printCommands prints the commands of the endpoint at addr. In newline
+// mode, it sends HELP by hand, like client does.
+func printCommands(addr string, framed bool, tlsConfig *tls.Config, opts ...ClientOption) error {
+	var infos []CommandInfo
+	if framed {
+		c, err := NewClient(addr, opts...)
+		if err != nil {
+			return errors.Wrap(err, "Client: Failed to open connection to "+addr)
+		}
+		defer c.Close()
+		infos, err = c.Help(context.Background(), "")
+		if err != nil {
+			return errors.Wrap(err, "HELP request failed")
+		}
+	} else {
+		conn, rw, err := open(addr, tlsConfig)
+		if err != nil {
+			return errors.Wrap(err, "Client: Failed to open connection to "+addr)
+		}
+		defer conn.Close()
+		if _, err := rw.WriteString(helpCommand + "\n\n"); err != nil {
+			return errors.Wrap(err, "Could not send the HELP request")
+		}
+		if err := rw.Flush(); err != nil {
+			return errors.Wrap(err, "Flush failed.")
+		}
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "Client: Failed to read the reply")
+		}
+		if line, err = ParseReplyLine(line); err != nil {
+			return errors.Wrap(err, "HELP request failed")
+		}
+		if err := json.Unmarshal([]byte(line), &infos); err != nil {
+			return errors.Wrap(err, "Cannot parse the HELP reply")
+		}
+	}
+	for _, info := range infos {
+		fmt.Printf("%s\t%s\n", info.Name, info.Description)
+		if info.Request != "" {
+			fmt.Printf("\trequest:  %s\n", info.Request)
+		}
+		if info.Response != "" {
+			fmt.Printf("\tresponse: %s\n", info.Response)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+// Package endpointtest runs an endpoint on an ephemeral port and talks to
+// it in framed mode, so that tests can check the replies of its handlers.
+//
+// The networking code is a main package, which cannot be imported.
+// Therefore the harness accepts anything that can Serve a listener and
+// Shutdown, and it speaks the frame format on its own:
+//
+//	e := NewEndpoint(WithFraming())
+//	e.AddHandler("STRING", handleStrings)
+//	h := endpointtest.Start(t, e)
+//	f := h.Client().Call("STRING", []byte("hello\n"))
+//	endpointtest.AssertReply(t, f, []byte("Thank you.\n"))
+//
+// The harness records all frames that its clients send and receive.
+package endpointtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Frame flags and the size of the fixed part of the header. They mirror
+// the networking package, whose tests check that they match.
+const (
+	FlagReply   byte = 1
+	FlagError   byte = 2
+	FlagOneWay  byte = 4
+	FlagReset   byte = 8
+	HeaderSize       = 10
+	maxNameSize      = 255
+)
+
+// DefaultTimeout limits how long a client waits for a reply, and how long
+// the harness waits for the endpoint to shut down.
+const DefaultTimeout = 5 * time.Second
+
+// Endpoint is what the harness needs from an endpoint.
+type Endpoint interface {
+	Serve(net.Listener) error
+	Shutdown(context.Context) error
+}
+
+// Frame is a request or reply frame.
+type Frame struct {
+	Flags   byte
+	ID      uint32
+	Command string
+	Payload []byte
+}
+
+// Status returns the status code and message of an error reply. ok is
+// false if f is not an error reply.
+func (f Frame) Status() (code uint16, msg string, ok bool) {
+	if f.Flags&FlagError == 0 || len(f.Payload) < 2 {
+		return 0, "", false
+	}
+	return binary.BigEndian.Uint16(f.Payload), string(f.Payload[2:]), true
+}
+
+// Direction tells whether a client sent or received a frame.
+type Direction int
+
+// Directions of recorded frames.
+const (
+	Sent Direction = iota
+	Received
+)
+
+func (d Direction) String() string {
+	if d == Sent {
+		return "sent"
+	}
+	return "received"
+}
+
+// Record is a frame that a client sent or received.
+type Record struct {
+	// Conn is the number of the client, starting at 0 for the one
+	// that Client returns.
+	Conn  int
+	Dir   Direction
+	Frame Frame
+}
+
+// Harness serves an endpoint on an ephemeral port for the duration of a
+// test.
+type Harness struct {
+	t testing.TB
+	e Endpoint
+	// Addr is the address that the endpoint listens on.
+	Addr string
+
+	mu      sync.Mutex
+	records []Record
+	clients []*Client
+}
+
+// Start serves e on an ephemeral port on the loopback interface. When the
+// test ends, the harness closes its clients and shuts e down.
+func Start(t testing.TB, e Endpoint) *Harness {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("endpointtest: cannot listen: %v", err)
+	}
+	h := &Harness{t: t, e: e, Addr: l.Addr().String()}
+	served := make(chan error, 1)
+	go func() { served <- e.Serve(l) }()
+
+	t.Cleanup(func() {
+		h.mu.Lock()
+		clients := h.clients
+		h.mu.Unlock()
+		for _, c := range clients {
+			c.conn.Close()
+		}
+		select {
+		case err := <-served:
+			t.Errorf("endpointtest: Serve returned before the end of the test: %v", err)
+			return
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			t.Errorf("endpointtest: Shutdown failed: %v", err)
+		}
+		<-served
+	})
+	return h
+}
+
+// Client returns the harness's first client, connecting it if needed.
+func (h *Harness) Client() *Client {
+	h.t.Helper()
+	h.mu.Lock()
+	if len(h.clients) > 0 {
+		c := h.clients[0]
+		h.mu.Unlock()
+		return c
+	}
+	h.mu.Unlock()
+	return h.Dial()
+}
+
+// Dial connects a new client.
+func (h *Harness) Dial() *Client {
+	h.t.Helper()
+	conn, err := net.DialTimeout("tcp", h.Addr, DefaultTimeout)
+	if err != nil {
+		h.t.Fatalf("endpointtest: cannot connect to %s: %v", h.Addr, err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := &Client{
+		h:       h,
+		n:       len(h.clients),
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		Timeout: DefaultTimeout,
+	}
+	h.clients = append(h.clients, c)
+	return c
+}
+
+// Records returns the frames that the clients have sent and received so
+// far, in order.
+func (h *Harness) Records() []Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Record(nil), h.records...)
+}
+
+func (h *Harness) record(r Record) {
+	h.mu.Lock()
+	h.records = append(h.records, r)
+	h.mu.Unlock()
+}
+
+// Client sends frames to the endpoint and reads its replies. A test
+// failure ends the test if sending or receiving fails.
+type Client struct {
+	h    *Harness
+	n    int
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// Timeout limits each Send and Receive. The default is
+	// DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Conn returns the client's connection, for tests that need to send
+// bytes that are not a valid frame.
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// Send sends a frame.
+func (c *Client) Send(f Frame) {
+	c.h.t.Helper()
+	if len(f.Command) > maxNameSize {
+		c.h.t.Fatalf("endpointtest: command name %q is too long", f.Command)
+	}
+	var hdr [HeaderSize]byte
+	hdr[0] = f.Flags
+	hdr[1] = byte(len(f.Command))
+	binary.BigEndian.PutUint32(hdr[2:], f.ID)
+	binary.BigEndian.PutUint32(hdr[6:], uint32(len(f.Payload)))
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	c.w.Write(hdr[:])
+	c.w.WriteString(f.Command)
+	c.w.Write(f.Payload)
+	if err := c.w.Flush(); err != nil {
+		c.h.t.Fatalf("endpointtest: cannot send %s: %v", f.Command, err)
+	}
+	c.h.record(Record{Conn: c.n, Dir: Sent, Frame: f})
+}
+
+// Receive reads the next frame.
+func (c *Client) Receive() Frame {
+	c.h.t.Helper()
+	f, err := c.receive()
+	if err != nil {
+		c.h.t.Fatalf("endpointtest: cannot receive a frame: %v", err)
+	}
+	return f
+}
+
+func (c *Client) receive() (Frame, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	var hdr [HeaderSize]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+	name := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c.r, name); err != nil {
+		return Frame{}, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(hdr[6:]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{Flags: hdr[0], ID: binary.BigEndian.Uint32(hdr[2:]), Command: string(name), Payload: payload}
+	c.h.record(Record{Conn: c.n, Dir: Received, Frame: f})
+	return f, nil
+}
+
+// Call sends a request and returns the reply.
+func (c *Client) Call(command string, payload []byte) Frame {
+	c.h.t.Helper()
+	c.Send(Frame{Command: command, Payload: payload})
+	return c.Receive()
+}
+
+// AssertClosed fails the test unless the endpoint closes the connection
+// without sending another frame.
+func (c *Client) AssertClosed() {
+	c.h.t.Helper()
+	f, err := c.receive()
+	if err == nil {
+		c.h.t.Fatalf("endpointtest: got frame %q, want a closed connection", f.Command)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.h.t.Fatalf("endpointtest: the connection is still open")
+	}
+}
+
+// AssertOK fails the test unless f is a successful reply, and returns
+// its payload.
+func AssertOK(t testing.TB, f Frame) []byte {
+	t.Helper()
+	if code, msg, ok := f.Status(); ok {
+		t.Fatalf("%s: got error reply %d (%s), want success", f.Command, code, msg)
+	}
+	if f.Flags&FlagReply == 0 {
+		t.Fatalf("%s: got flags %#x, want a reply", f.Command, f.Flags)
+	}
+	return f.Payload
+}
+
+// AssertReply fails the test unless f is a successful reply with the
+// given payload.
+func AssertReply(t testing.TB, f Frame, want []byte) {
+	t.Helper()
+	if got := AssertOK(t, f); !bytes.Equal(got, want) {
+		t.Fatalf("%s: got reply %q, want %q", f.Command, got, want)
+	}
+}
+
+// AssertError fails the test unless f is an error reply with the given
+// status code, and returns the message.
+func AssertError(t testing.TB, f Frame, code uint16) string {
+	t.Helper()
+	got, msg, ok := f.Status()
+	if !ok {
+		t.Fatalf("%s: got reply %q, want error %d", f.Command, f.Payload, code)
+	}
+	if got != code {
+		t.Fatalf("%s: got error %d (%s), want error %d", f.Command, got, msg, code)
+	}
+	return msg
+}
@@ -0,0 +1,344 @@
+package main
+
+/*
+## Framed messages
+
+The newline protocol leaves it to each handler to read exactly the right
+amount of payload data. If a handler reads too little or too much, the next
+command name is read from the wrong position, and the connection is lost.
+
+In framed mode, each message starts with a fixed-size header that tells the
+command name, the request ID, and the payload size:
+
+    +-------+---------+----------------+----------------+---------+---------+
+    | flags | namelen |   request ID   | payload length |  name   | payload |
+    | 1 (B) | 1       | 4 (big endian) | 4 (big endian) | namelen | length  |
+    +-------+---------+----------------+----------------+---------+---------+
+
+The endpoint hands each handler only the payload of its own frame and skips
+whatever the handler leaves unread. Everything the handler writes is
+collected and sent back as a reply frame with the same command name.
+Unknown commands and malformed frames get an error reply frame instead.
+Requests flagged as one-way get no reply at all. A reply carries the ID of
+its request; see mux.go for requests with a non-zero ID.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Frame flags.
+const (
+	// FlagReply marks a frame that an endpoint sends back to the client.
+	FlagReply byte = 1 << iota
+	// FlagError marks a reply frame that carries an error (see status.go).
+	FlagError
+	// FlagOneWay marks a request that the endpoint does not reply to.
+	FlagOneWay
+	// FlagReset marks a frame whose sender has started a new codec
+	// stream (see stream.go).
+	FlagReset
+)
+
+// frameHeaderSize is the size of the fixed part of the frame header.
+const frameHeaderSize = 10
+
+// maxCommandLen is the longest command name that fits into a frame header.
+const maxCommandLen = 255
+
+// readChunk is the largest payload that ReadFrame allocates in advance.
+const readChunk = 64 << 10
+
+// Frame is a single message in framed mode.
+type Frame struct {
+	Flags byte
+	// ID correlates a reply with its request. Requests with ID 0 are
+	// processed one after the other.
+	ID      uint32
+	Command string
+	Payload []byte
+}
+
+// frameHeader is the decoded header of a frame whose payload has not
+// been read yet.
+type frameHeader struct {
+	flags   byte
+	id      uint32
+	command string
+	length  uint32
+}
+
+// WithFraming lets the endpoint expect framed messages instead of
+// newline-terminated commands.
+func WithFraming() Option {
+	return func(e *Endpoint) {
+		e.framed = true
+	}
+}
+
+// WriteFrame writes a frame to w. It does not flush buffered writers.
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Command) > maxCommandLen {
+		return errors.Errorf("Command name %q exceeds %d bytes", f.Command, maxCommandLen)
+	}
+	if uint64(len(f.Payload)) > uint64(^uint32(0)) {
+		return errors.Errorf("Payload of %d bytes is too large", len(f.Payload))
+	}
+	hdr := make([]byte, frameHeaderSize, frameHeaderSize+len(f.Command))
+	hdr[0] = f.Flags
+	hdr[1] = byte(len(f.Command))
+	binary.BigEndian.PutUint32(hdr[2:], f.ID)
+	binary.BigEndian.PutUint32(hdr[6:], uint32(len(f.Payload)))
+	hdr = append(hdr, f.Command...)
+	if _, err := w.Write(hdr); err != nil {
+		return errors.Wrap(err, "Cannot write frame header")
+	}
+	if _, err := w.Write(f.Payload); err != nil {
+		return errors.Wrap(err, "Cannot write frame payload")
+	}
+	return nil
+}
+
+// ReadFrame reads a complete frame from r. It does not limit the size of
+// the payload - the endpoint checks the header against WithMaxPayload
+// before it reads a request - but it allocates the payload as it
+// arrives, so that a header that announces more bytes than follow
+// cannot exhaust memory.
+func ReadFrame(r io.Reader) (Frame, error) {
+	hdr, err := readFrameHeader(r)
+	if err != nil {
+		return Frame{}, err
+	}
+	payload, err := readPayload(r, hdr.length)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Flags: hdr.flags, ID: hdr.id, Command: hdr.command, Payload: payload}, nil
+}
+
+// readPayload reads a payload of n bytes. It allocates at most readChunk
+// bytes in advance and grows the buffer as the data arrives.
+func readPayload(r io.Reader, n uint32) ([]byte, error) {
+	var payload bytes.Buffer
+	if n <= readChunk {
+		payload.Grow(int(n))
+	}
+	if _, err := io.CopyN(&payload, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "Cannot read frame payload")
+	}
+	return payload.Bytes(), nil
+}
+
+// readFrameHeader reads the header of the next frame. It returns io.EOF
+// unwrapped if the stream ends cleanly before a new frame.
+func readFrameHeader(r io.Reader) (frameHeader, error) {
+	var fixed [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		if err == io.EOF {
+			return frameHeader{}, err
+		}
+		return frameHeader{}, errors.Wrap(err, "Cannot read frame header")
+	}
+	name := make([]byte, fixed[1])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return frameHeader{}, errors.Wrap(err, "Cannot read command name")
+	}
+	return frameHeader{
+		flags:   fixed[0],
+		id:      binary.BigEndian.Uint32(fixed[2:]),
+		command: string(name),
+		length:  binary.BigEndian.Uint32(fixed[6:]),
+	}, nil
+}
+
+// handleFrames is the framed counterpart of handleMessages. It reads one
+// frame at a time, passes the payload to the registered handler, and
+// replies with whatever the handler has written. Requests with an ID are
+// handed over to serveConcurrent.
+func (e *Endpoint) handleFrames(ctx context.Context, conn net.Conn, rw *bufio.ReadWriter) {
+	fc := e.newFrameConn(ctx, conn, rw)
+	// Let concurrent handlers finish before the connection gets closed.
+	defer fc.wg.Wait()
+
+	// The handlers' buffers live as long as the connection, so that the
+	// persistent decoder and encoder stay attached to them.
+	sess := sessionFromContext(ctx)
+	var replyBuf bytes.Buffer
+	frw := bufio.NewReadWriter(bufio.NewReader(nil), bufio.NewWriter(&replyBuf))
+	logger := LoggerFromContext(ctx)
+	for {
+		if !fc.waitForFrame() {
+			logger.Debug("Endpoint is shutting down")
+			return
+		}
+		hdr, err := readFrameHeader(rw)
+		switch {
+		case err == io.EOF:
+			logger.Debug("Reached EOF")
+			return
+		case isTimeout(err):
+			logger.Info("Idle timeout")
+			fc.replyTimeout(0, "", "idle timeout")
+			return
+		case err != nil:
+			logger.Warn("Cannot read frame", errorAttr(err))
+			return
+		}
+		fc.gotFrame()
+		e.setConnState(conn, connActive)
+		e.setCommandDeadline(conn)
+		logger.Debug("Receive frame", "command", hdr.command, "id", hdr.id, "bytes", hdr.length)
+		// Reject an oversized payload before reading or allocating it.
+		// Skipping it would take too long, so the connection ends here.
+		if int64(hdr.length) > int64(e.maxPayload) {
+			logger.Warn("Payload too large", "command", hdr.command, "bytes", hdr.length)
+			reply := errorFrame(hdr.command, StatusMalformed,
+				fmt.Sprintf("payload of %d bytes exceeds %d bytes", hdr.length, e.maxPayload))
+			reply.ID = hdr.id
+			fc.send(reply)
+			return
+		}
+		if hdr.flags&FlagReset != 0 {
+			sess.resetStreams()
+		}
+
+		payload := &io.LimitedReader{R: rw, N: int64(hdr.length)}
+		handleCommand, ok := e.lookup(hdr.command)
+
+		var reply Frame
+		switch {
+		case hdr.flags&FlagReply != 0:
+			logger.Warn("Unexpected reply frame", "command", hdr.command)
+			reply = errorFrame(hdr.command, StatusMalformed, "unexpected reply frame")
+		case !ok:
+			logger.Warn("Unknown command", "command", hdr.command)
+			e.metrics.UnknownCommand()
+			reply = errorFrame(hdr.command, StatusUnknownCommand, "command "+hdr.command+" is not registered")
+		case hdr.id != 0:
+			if !e.serveConcurrent(ctx, fc, hdr, handleCommand) {
+				return
+			}
+			continue
+		default:
+			frw.Reader.Reset(payload)
+			replyBuf.Reset()
+			frw.Writer.Reset(&replyBuf)
+			rerr := e.runHandler(ctx, 0, hdr.command, handleCommand, frw)
+			if rerr == nil {
+				rerr = flushReply(frw)
+			}
+			switch {
+			case rerr != nil:
+				// Drop any partial reply in favor of the error. The
+				// encoder may have written type information into it.
+				sess.resetEncoder()
+				reply = errorFrame(hdr.command, rerr.Code, rerr.Message)
+			case hdr.flags&FlagOneWay != 0:
+				// The reply is dropped, too.
+				sess.resetEncoder()
+			default:
+				reply = Frame{Flags: FlagReply, Command: hdr.command, Payload: replyBuf.Bytes()}
+				if sess.takeFresh() {
+					reply.Flags |= FlagReset
+				}
+			}
+		}
+
+		// Skip any payload that the handler did not consume, so that the
+		// next read starts at a frame boundary.
+		if _, err := io.Copy(ioutil.Discard, payload); err != nil {
+			logger.Warn("Cannot skip the payload", "command", hdr.command, errorAttr(err))
+			if isTimeout(err) {
+				fc.replyTimeout(hdr.id, hdr.command, "timeout reading the payload")
+			}
+			return
+		}
+		reply.ID = hdr.id
+
+		// After a timeout, the connection is closed, as the client is
+		// evidently too slow or stuck. The same goes for a client that
+		// speaks an incompatible protocol version, and optionally for a
+		// handler that panicked.
+		var rerr *RemoteError
+		closing := errors.As(reply.Err(), &rerr) && e.closesConnection(rerr.Code)
+		if hdr.flags&FlagOneWay != 0 {
+			if err := reply.Err(); err != nil {
+				logger.Debug("One-way command failed", "command", hdr.command, errorAttr(err))
+			}
+			if closing {
+				return
+			}
+			continue
+		}
+		if err := fc.send(reply); err != nil {
+			logger.Warn("Cannot send the reply", "command", hdr.command, errorAttr(err))
+			return
+		}
+		if closing {
+			logger.Info("Close the connection", "status", rerr.Code.String())
+			return
+		}
+	}
+}
+
+// writeFlush writes a frame and flushes the buffer.
+func writeFlush(rw *bufio.ReadWriter, f Frame) error {
+	if err := WriteFrame(rw, f); err != nil {
+		return err
+	}
+	return errors.Wrap(rw.Flush(), "Flush failed.")
+}
+
+// flushReply flushes whatever the handler left in the reply buffer.
+func flushReply(rw *bufio.ReadWriter) *RemoteError {
+	if err := rw.Flush(); err != nil {
+		return &RemoteError{Code: StatusHandlerFailed, Message: "flush failed: " + err.Error()}
+	}
+	return nil
+}
+
+// framedClient does the same as client, but uses a Client that sends
+// each request as a frame and waits for the reply frame.
+func framedClient(addr string, opts ...ClientOption) error {
+	c, err := NewClient(addr, opts...)
+	if err != nil {
+		return errors.Wrap(err, "Client: Failed to open connection to "+addr)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	slog.Debug("Send the string request.")
+	var response string
+	err = c.Call(ctx, "STRING", "Additional data.\n", &response)
+	if err != nil {
+		return errors.Wrap(err, "STRING request failed")
+	}
+	slog.Info("STRING request: got a response", "response", response)
+
+	slog.Debug("Send a struct as GOB.")
+	err = c.Call(ctx, "GOB", testData(), nil)
+	if err != nil {
+		return errors.Wrap(err, "GOB request failed")
+	}
+
+	slog.Debug("Send a struct to ECHO.")
+	echo, err := Call[complexData, complexData](ctx, c, "ECHO", testData())
+	if err != nil {
+		return errors.Wrap(err, "ECHO request failed")
+	}
+	slog.Info("ECHO request: got a response", "response", fmt.Sprintf("%#v", echo))
+	return nil
+}
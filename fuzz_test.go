@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appliedgo/networking/endpointtest"
+)
+
+// fuzzConn is a connection that reads from a byte slice and collects
+// whatever the endpoint writes. Deadlines have no effect.
+type fuzzConn struct {
+	r   io.Reader
+	out bytes.Buffer
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c *fuzzConn) Write(p []byte) (int, error)      { return c.out.Write(p) }
+func (c *fuzzConn) Close() error                     { return nil }
+func (c *fuzzConn) LocalAddr() net.Addr              { return memAddr{} }
+func (c *fuzzConn) RemoteAddr() net.Addr             { return memAddr{} }
+func (c *fuzzConn) SetDeadline(time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(time.Time) error { return nil }
+
+// serveBytes runs the endpoint's dispatch loop on data, as if a client
+// had sent it, and returns what the endpoint replied. It fails if a
+// handler or the loop panicked.
+func serveBytes(t *testing.T, e *Endpoint, data []byte) []byte {
+	conn := &fuzzConn{r: bytes.NewReader(data)}
+	if err := e.trackConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	e.handleMessages(conn)
+	if n := e.Panics(); n > 0 {
+		t.Fatalf("Recovered %d panics for input %q", n, data)
+	}
+	return conn.out.Bytes()
+}
+
+// fuzzMaxPayload keeps the fuzzer from spending its time on huge inputs.
+const fuzzMaxPayload = 1 << 16
+
+func gobBytes(t testing.TB, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func frameBytes(t testing.TB, frames ...Frame) []byte {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func FuzzHandleMessages(f *testing.F) {
+	f.Add([]byte("STRING\nhello\n"))
+	f.Add(append([]byte("GOB\n"), gobBytes(f, testData())...))
+	f.Add(append([]byte("ECHO\n"), gobBytes(f, testData())...))
+	f.Add([]byte("HELLO\n{\"version\":1,\"name\":\"fuzz\"}\nLIST\nHELP\nECHO\n"))
+	f.Add([]byte("CODEC\njson\nECHO\n{\"N\":1,\"C\":{\"S\":\"x\"}}\n"))
+	f.Add([]byte("\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		serveBytes(t, serverEndpoint(WithMaxPayload(fuzzMaxPayload)), data)
+	})
+}
+
+func FuzzHandleFrames(f *testing.F) {
+	f.Add(frameBytes(f, Frame{Command: "STRING", Payload: []byte("hello\n")}))
+	f.Add(frameBytes(f,
+		Frame{Command: "GOB", Payload: gobBytes(f, testData())},
+		Frame{Flags: FlagReset, Command: "ECHO", Payload: gobBytes(f, testData())}))
+	f.Add(frameBytes(f,
+		Frame{ID: 1, Command: "ECHO", Payload: gobBytes(f, testData())},
+		Frame{ID: 2, Flags: FlagOneWay, Command: "STRING", Payload: []byte("x\n")},
+		Frame{Command: "HELP", Payload: []byte("ECHO\n")}))
+	f.Add(frameBytes(f,
+		Frame{Command: "CODEC", Payload: []byte("json\n")},
+		Frame{Command: "ECHO", Payload: []byte(`{"S":"x"}`)}))
+	f.Add(frameBytes(f, Frame{Flags: FlagReply | FlagError, Command: "NOPE"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		serveBytes(t, serverEndpoint(WithFraming(), WithMaxPayload(fuzzMaxPayload)), data)
+	})
+}
+
+// FuzzReadFrame checks that each frame that ReadFrame accepts is written
+// back unchanged.
+func FuzzReadFrame(f *testing.F) {
+	f.Add(frameBytes(f, Frame{Flags: FlagReply, ID: 7, Command: "ECHO", Payload: []byte("data")}))
+	f.Add(frameBytes(f, Frame{}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		got := frameBytes(t, frame)
+		if !bytes.Equal(got, data[:len(got)]) {
+			t.Fatalf("Frame %+v was written as %q, read from %q", frame, got, data)
+		}
+	})
+}
+
+// FuzzCodecs decodes arbitrary bytes with each codec. Whatever decodes
+// must encode and decode again to the same value.
+func FuzzCodecs(f *testing.F) {
+	f.Add(gobBytes(f, testData()))
+	data, err := json.Marshal(testData())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+			var v complexData
+			if err := codec.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+				continue
+			}
+			var buf bytes.Buffer
+			if err := codec.NewEncoder(&buf).Encode(v); err != nil {
+				t.Fatalf("%s: cannot encode %#v: %v", codec.Name(), v, err)
+			}
+			var w complexData
+			if err := codec.NewDecoder(&buf).Decode(&w); err != nil {
+				t.Fatalf("%s: cannot decode %#v: %v", codec.Name(), v, err)
+			}
+			if !reflect.DeepEqual(v, w) {
+				t.Fatalf("%s: got %#v, want %#v", codec.Name(), w, v)
+			}
+		}
+	})
+}
+
+func TestCommandLineTooLong(t *testing.T) {
+	data := []byte(strings.Repeat("A", 10000) + "\n")
+	out := serveBytes(t, serverEndpoint(), data)
+	_, err := ParseReplyLine(string(out))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != StatusMalformed {
+		t.Fatalf("Got reply %q, want StatusMalformed", out)
+	}
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	h := endpointtest.Start(t, serverEndpoint(WithFraming(), WithMaxPayload(1024)))
+	c := h.Client()
+	// Announce a payload of 1 GiB without sending it.
+	hdr := make([]byte, frameHeaderSize, frameHeaderSize+3)
+	hdr[1] = 3
+	binary.BigEndian.PutUint32(hdr[6:], 1<<30)
+	if _, err := c.Conn().Write(append(hdr, "GOB"...)); err != nil {
+		t.Fatal(err)
+	}
+	endpointtest.AssertError(t, c.Receive(), uint16(StatusMalformed))
+	c.AssertClosed()
+}
+
+// TestConcurrentPayloadMemory announces the largest payload that the
+// endpoint accepts for a concurrent request, but sends only a few bytes.
+// The endpoint must not allocate the announced size up front.
+func TestConcurrentPayloadMemory(t *testing.T) {
+	hdr := make([]byte, frameHeaderSize, frameHeaderSize+4)
+	hdr[1] = 4
+	binary.BigEndian.PutUint32(hdr[2:], 1)
+	binary.BigEndian.PutUint32(hdr[6:], DefaultMaxPayload)
+	data := append(append(hdr, "ECHO"...), "abc"...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	serveBytes(t, serverEndpoint(WithFraming()), data)
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > DefaultMaxPayload/4 {
+		t.Fatalf("Allocated %d bytes for a payload of 3 bytes", n)
+	}
+}
+
+func TestLinePayloadTooLarge(t *testing.T) {
+	data := append([]byte("STRING\n"), bytes.Repeat([]byte("A"), 100000)...)
+	out := serveBytes(t, serverEndpoint(WithMaxPayload(1024)), append(data, '\n'))
+	if _, err := ParseReplyLine(string(out)); err == nil {
+		t.Fatalf("Got reply %q, want an error", out)
+	}
+}
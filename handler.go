@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Handler handles an incoming command, like HandleFunc. In addition, it
+// receives a context and can report failure. The context carries the
+// RequestInfo, expires after the handler timeout, and is cancelled when
+// the connection closes or the endpoint shuts down.
+//
+// If a Handler returns an error, the endpoint sends an error reply to the
+// client. Return a *RemoteError to choose the status code; any other
+// error is reported as StatusHandlerFailed.
+type Handler func(ctx context.Context, rw *bufio.ReadWriter) error
+
+// RequestInfo describes the connection and command that a handler serves.
+type RequestInfo struct {
+	ConnID     uint64
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Command    string
+	// ID is the request ID of a concurrent request in framed mode (see
+	// mux.go), or 0.
+	ID uint32
+	// TLS is the state of a TLS connection, or nil for plain TCP.
+	TLS *tls.ConnectionState
+	// Cred identifies the peer process of a Unix socket on Linux, and
+	// is nil otherwise. See unix.go.
+	Cred *PeerCred
+}
+
+// requestInfoKey is the context key for the RequestInfo.
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the RequestInfo that the endpoint
+// stored in a handler's context.
+func RequestInfoFromContext(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// WithHandlerTimeout sets a deadline on each handler's context.
+// The default is no deadline.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(e *Endpoint) {
+		e.handlerTimeout = d
+	}
+}
+
+// command is a registered handler along with its settings.
+type command struct {
+	h     Handler
+	codec Codec
+	// info is reported by HELP. See discovery.go.
+	info CommandInfo
+	// middleware wraps h. See middleware.go.
+	middleware []Middleware
+}
+
+// HandlerOption configures a command at registration time.
+type HandlerOption func(*command)
+
+// AddHandler adds a new context-aware handler for incoming data.
+func (e *Endpoint) AddHandler(name string, h Handler, opts ...HandlerOption) {
+	cmd := &command{h: h}
+	for _, opt := range opts {
+		opt(cmd)
+	}
+	e.m.Lock()
+	e.handler[name] = cmd
+	e.m.Unlock()
+}
+
+// lookup returns the command registered under name.
+func (e *Endpoint) lookup(name string) (*command, bool) {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	cmd, ok := e.handler[name]
+	return cmd, ok
+}
+
+// session holds the state of a connection that commands can change.
+type session struct {
+	mu      sync.Mutex
+	codec   Codec
+	streams streams
+	// peer is the client's Hello, or nil before the handshake.
+	peer *Hello
+}
+
+// sessionKey is the context key for the session.
+type sessionKey struct{}
+
+// sessionFromContext returns the session of the handler's connection.
+func sessionFromContext(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
+}
+
+func (s *session) setCodec(c Codec) {
+	s.mu.Lock()
+	s.codec = c
+	s.mu.Unlock()
+}
+
+func (s *session) getCodec() Codec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.codec
+}
+
+// newConnID returns a unique ID for a new connection.
+func (e *Endpoint) newConnID() uint64 {
+	return e.nextConnID.Add(1)
+}
+
+// connContext creates the context for a new connection. It is cancelled
+// when the endpoint shuts down.
+func (e *Endpoint) connContext(conn net.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(e.baseCtx)
+	info := &RequestInfo{
+		ConnID:     e.newConnID(),
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+		Cred:       peerCred(conn),
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+	}
+	ctx = context.WithValue(ctx, sessionKey{}, &session{codec: e.codec})
+	ctx = context.WithValue(ctx, loggerKey{}, e.connLogger(info.ConnID, conn))
+	return context.WithValue(ctx, requestInfoKey{}, info), cancel
+}
+
+// runHandler calls the command's handler with a context for the request.
+// If the handler fails, runHandler logs the error and returns it as a
+// *RemoteError that can be sent back to the client.
+func (e *Endpoint) runHandler(connCtx context.Context, id uint32, name string, cmd *command, rw *bufio.ReadWriter) *RemoteError {
+	info, _ := RequestInfoFromContext(connCtx)
+	reqInfo := *info
+	reqInfo.Command = name
+	reqInfo.ID = id
+	ctx := context.WithValue(connCtx, requestInfoKey{}, &reqInfo)
+	logger := LoggerFromContext(connCtx).With("command", name)
+	if id != 0 {
+		logger = logger.With("id", id)
+	}
+	ctx = context.WithValue(ctx, loggerKey{}, logger)
+	codec := cmd.codec
+	if codec == nil {
+		codec = sessionFromContext(connCtx).getCodec()
+	}
+	ctx = context.WithValue(ctx, codecKey{}, codec)
+	if e.handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.handlerTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := e.callHandler(ctx, cmd, rw)
+	d := time.Since(start)
+	if err == nil {
+		e.metrics.CommandDone(name, d, 0)
+		return nil
+	}
+	// A RemoteError means that the handler refused the request, which is
+	// the client's mistake, and so is a request that ends too early or a
+	// connection that the client closed. Anything else is a failure of
+	// the endpoint.
+	var rerr *RemoteError
+	switch {
+	case errors.As(err, &rerr):
+		level := slog.LevelWarn
+		if rerr.Code == StatusInternal {
+			level = slog.LevelError
+		}
+		logger.Log(ctx, level, "Command failed", "duration", d, "status", rerr.Code.String(), errorAttr(err))
+	case isTimeout(err):
+		logger.Error("Command failed", "duration", d, errorAttr(err))
+		rerr = &RemoteError{Code: StatusTimeout, Message: err.Error()}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		logger.Warn("Command failed", "duration", d, errorAttr(err))
+		rerr = &RemoteError{Code: StatusHandlerFailed, Message: err.Error()}
+	default:
+		logger.Error("Command failed", "duration", d, errorAttr(err))
+		rerr = &RemoteError{Code: StatusHandlerFailed, Message: err.Error()}
+	}
+	e.metrics.CommandDone(name, d, rerr.Code)
+	if rerr.Code == StatusMalformed {
+		e.metrics.DecodeError(name)
+	}
+	return rerr
+}
+
+// WithCloseOnPanic makes the endpoint close a framed connection after a
+// handler panicked. By default, only the request fails, and the
+// connection stays open. In newline mode, the connection is closed
+// anyway.
+func WithCloseOnPanic() Option {
+	return func(e *Endpoint) {
+		e.closeOnPanic = true
+	}
+}
+
+// Panics returns the number of panics that the endpoint has recovered.
+func (e *Endpoint) Panics() uint64 {
+	return e.panics.Load()
+}
+
+// callHandler calls the command's handler along with its middleware. It
+// turns a panic into an error reply with StatusInternal, so that a faulty
+// handler cannot crash the whole endpoint.
+func (e *Endpoint) callHandler(ctx context.Context, cmd *command, rw *bufio.ReadWriter) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			e.panics.Add(1)
+			info, _ := RequestInfoFromContext(ctx)
+			LoggerFromContext(ctx).Error("Command panicked", "panic", p, "stack", string(debug.Stack()))
+			err = &RemoteError{Code: StatusInternal, Message: "command " + info.Command + " panicked"}
+		}
+	}()
+	return e.wrap(cmd)(ctx, rw)
+}
+
+// recoverConn recovers from a panic outside of a handler, so that it
+// only takes down the affected connection.
+func (e *Endpoint) recoverConn(conn net.Conn) {
+	if p := recover(); p != nil {
+		e.panics.Add(1)
+		e.logger.Error("Connection panicked", "remote", conn.RemoteAddr().String(), "panic", p, "stack", string(debug.Stack()))
+	}
+}
+
+// closesConnection reports whether the endpoint closes a framed
+// connection after an error reply with the given status.
+func (e *Endpoint) closesConnection(code StatusCode) bool {
+	return code.closesConnection() || code == StatusInternal && e.closeOnPanic
+}
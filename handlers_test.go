@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/appliedgo/networking/endpointtest"
+)
+
+func startServer(t *testing.T) *endpointtest.Harness {
+	return endpointtest.Start(t, serverEndpoint(WithFraming()))
+}
+
+func TestStringHandler(t *testing.T) {
+	h := startServer(t)
+	f := h.Client().Call("STRING", []byte("Additional data.\n"))
+	endpointtest.AssertReply(t, f, []byte("Thank you.\n"))
+
+	records := h.Records()
+	if len(records) != 2 || records[0].Dir != endpointtest.Sent || records[1].Dir != endpointtest.Received {
+		t.Fatalf("got records %+v, want one request and one reply", records)
+	}
+}
+
+func TestStringHandlerWithoutNewline(t *testing.T) {
+	h := startServer(t)
+	f := h.Client().Call("STRING", []byte("no newline"))
+	endpointtest.AssertError(t, f, uint16(StatusMalformed))
+}
+
+func TestGobHandler(t *testing.T) {
+	h := startServer(t)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(testData()); err != nil {
+		t.Fatal(err)
+	}
+	f := h.Client().Call("GOB", buf.Bytes())
+	endpointtest.AssertReply(t, f, nil)
+}
+
+// TestGobHandlerStream sends two values from the same encoder. The
+// second frame carries no type information, so the endpoint must keep
+// its decoder between the requests.
+func TestGobHandlerStream(t *testing.T) {
+	h := startServer(t)
+	c := h.Client()
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		if err := enc.Encode(testData()); err != nil {
+			t.Fatal(err)
+		}
+		endpointtest.AssertReply(t, c.Call("GOB", buf.Bytes()), nil)
+	}
+}
+
+func TestGobHandlerMalformed(t *testing.T) {
+	h := startServer(t)
+	f := h.Client().Call("GOB", []byte("not a gob"))
+	endpointtest.AssertError(t, f, uint16(StatusMalformed))
+}
+
+func TestUnknownCommand(t *testing.T) {
+	h := startServer(t)
+	f := h.Client().Call("NOPE", nil)
+	endpointtest.AssertError(t, f, uint16(StatusUnknownCommand))
+}
+
+// The harness speaks the frame format on its own. These tests keep its
+// copy in step with framing.go and status.go.
+
+func TestHarnessConstants(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		got, want int
+	}{
+		{"FlagReply", int(endpointtest.FlagReply), int(FlagReply)},
+		{"FlagError", int(endpointtest.FlagError), int(FlagError)},
+		{"FlagOneWay", int(endpointtest.FlagOneWay), int(FlagOneWay)},
+		{"FlagReset", int(endpointtest.FlagReset), int(FlagReset)},
+		{"HeaderSize", endpointtest.HeaderSize, frameHeaderSize},
+	} {
+		if c.got != c.want {
+			t.Errorf("endpointtest.%s is %d, want %d", c.name, c.got, c.want)
+		}
+	}
+}
+
+// replayEndpoint reads one request with ReadFrame from each connection
+// and answers with its frames, written by WriteFrame.
+type replayEndpoint struct {
+	frames   []Frame
+	requests chan Frame
+	done     chan struct{}
+}
+
+func (e *replayEndpoint) Serve(l net.Listener) error {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				f, err := ReadFrame(conn)
+				if err != nil {
+					return
+				}
+				e.requests <- f
+				for _, f := range e.frames {
+					if WriteFrame(conn, f) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	<-e.done
+	return l.Close()
+}
+
+func (e *replayEndpoint) Shutdown(ctx context.Context) error {
+	close(e.done)
+	return nil
+}
+
+func TestHarnessFrames(t *testing.T) {
+	e := &replayEndpoint{
+		frames: []Frame{
+			{Flags: FlagReply | FlagReset, ID: 42, Command: "ECHO", Payload: []byte("data")},
+			errorFrame("NOPE", StatusUnknownCommand, "unknown command"),
+		},
+		requests: make(chan Frame, 1),
+		done:     make(chan struct{}),
+	}
+	h := endpointtest.Start(t, e)
+	c := h.Client()
+
+	c.Send(endpointtest.Frame{Flags: endpointtest.FlagOneWay, ID: 7, Command: "STRING", Payload: []byte("hello\n")})
+	want := Frame{Flags: FlagOneWay, ID: 7, Command: "STRING", Payload: []byte("hello\n")}
+	if got := <-e.requests; !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadFrame got %+v, want %+v", got, want)
+	}
+
+	for _, want := range e.frames {
+		got := c.Receive()
+		if got.Flags != want.Flags || got.ID != want.ID || got.Command != want.Command || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("Harness got %+v, want %+v", got, want)
+		}
+	}
+	f := h.Records()[2].Frame
+	if msg := endpointtest.AssertError(t, f, uint16(StatusUnknownCommand)); msg != "unknown command" {
+		t.Fatalf("Got message %q, want %q", msg, "unknown command")
+	}
+}
+
+// The handlers were written for the newline protocol, which the harness
+// does not speak.
+
+func TestStringHandlerLines(t *testing.T) {
+	out := serveBytes(t, serverEndpoint(), []byte("STRING\nhello\n"))
+	if string(out) != "Thank you.\n" {
+		t.Fatalf("Got reply %q, want %q", out, "Thank you.\n")
+	}
+}
+
+func TestGobHandlerLines(t *testing.T) {
+	out := serveBytes(t, serverEndpoint(), append([]byte("GOB\n"), gobBytes(t, testData())...))
+	if len(out) != 0 {
+		t.Fatalf("Got reply %q, want none", out)
+	}
+}
+
+func TestStringHandlerLinesWithoutNewline(t *testing.T) {
+	out := serveBytes(t, serverEndpoint(), []byte("STRING\nhello"))
+	_, err := ParseReplyLine(string(out))
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != StatusMalformed {
+		t.Fatalf("Got reply %q, want StatusMalformed", out)
+	}
+}
+
+func panicEndpoint(opts ...Option) *Endpoint {
+	e := serverEndpoint(opts...)
+	e.AddHandler("PANIC", func(ctx context.Context, rw *bufio.ReadWriter) error {
+		panic("out of luck")
+	})
+	return e
+}
+
+func TestPanicLines(t *testing.T) {
+	e := panicEndpoint()
+	conn := &fuzzConn{r: bytes.NewReader([]byte("PANIC\nSTRING\nhello\n"))}
+	if err := e.trackConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	e.handleMessages(conn)
+	if n := e.Panics(); n != 1 {
+		t.Fatalf("Got %d panics, want 1", n)
+	}
+	// The connection is closed after the error reply.
+	out := conn.out.String()
+	_, err := ParseReplyLine(out)
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Code != StatusInternal || strings.Count(out, "\n") != 1 {
+		t.Fatalf("Got reply %q, want a single StatusInternal", out)
+	}
+}
+
+func TestPanicFrames(t *testing.T) {
+	for _, closeOnPanic := range []bool{false, true} {
+		opts := []Option{WithFraming()}
+		if closeOnPanic {
+			opts = append(opts, WithCloseOnPanic())
+		}
+		e := panicEndpoint(opts...)
+		c := endpointtest.Start(t, e).Client()
+		endpointtest.AssertError(t, c.Call("PANIC", nil), uint16(StatusInternal))
+		if n := e.Panics(); n != 1 {
+			t.Fatalf("Got %d panics, want 1", n)
+		}
+		if closeOnPanic {
+			c.AssertClosed()
+			continue
+		}
+		endpointtest.AssertReply(t, c.Call("STRING", []byte("hello\n")), []byte("Thank you.\n"))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+/*
+## Handshake
+
+Clients and endpoints evolve, and sooner or later a client talks to an
+endpoint that speaks another variant of the protocol. To find out right
+away, a client can open the conversation with the HELLO command. Its
+payload is a single line of JSON - readable from any language, whatever
+codec the connection uses later - with the protocol version, the codecs
+and features that the client supports, and the client's name:
+
+    HELLO\n{"version":1,"name":"demo","codecs":["gob"],"features":["framing"]}\n
+
+The endpoint replies with the same information about itself. If it does
+not support the client's protocol version, it sends an error reply with
+StatusIncompatible instead and closes the connection.
+
+The Client sends HELLO on each new connection and checks the endpoint's
+version in turn. Features that a peer does not know, such as compression,
+are simply ignored.
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// helloCommand is the built-in command for the handshake.
+const helloCommand = "HELLO"
+
+// ProtocolVersion is the version of the protocol that this package
+// speaks. minProtocolVersion is the oldest version it still supports.
+const (
+	ProtocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// Features that a peer can announce in its Hello.
+const (
+	// FeatureFraming means that the peer speaks framed mode.
+	FeatureFraming = "framing"
+	// FeatureMultiplexing means that the peer sends or serves
+	// concurrent requests (see mux.go).
+	FeatureMultiplexing = "mux"
+	// FeatureTLS means that the connection is encrypted.
+	FeatureTLS = "tls"
+	// FeatureAuth means that the peer authenticates with a client
+	// certificate, or that the endpoint requires one.
+	FeatureAuth = "auth"
+)
+
+// Hello describes a peer during the handshake.
+type Hello struct {
+	Version  int      `json:"version"`
+	Name     string   `json:"name,omitempty"`
+	Codecs   []string `json:"codecs,omitempty"`
+	Features []string `json:"features,omitempty"`
+}
+
+// Has reports whether the peer announced the given feature.
+func (h Hello) Has(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersion returns an error reply if version is not supported.
+func checkVersion(version int) *RemoteError {
+	if version >= minProtocolVersion && version <= ProtocolVersion {
+		return nil
+	}
+	return &RemoteError{
+		Code: StatusIncompatible,
+		Message: "protocol version " + strconv.Itoa(version) + " is not supported, expected " +
+			strconv.Itoa(minProtocolVersion) + " to " + strconv.Itoa(ProtocolVersion),
+	}
+}
+
+// WithName sets the name that the endpoint announces in the handshake.
+func WithName(name string) Option {
+	return func(e *Endpoint) {
+		e.name = name
+	}
+}
+
+// WithClientName sets the name that the Client announces in the
+// handshake.
+func WithClientName(name string) ClientOption {
+	return func(c *Client) {
+		c.name = name
+	}
+}
+
+// hello describes the endpoint.
+func (e *Endpoint) hello() Hello {
+	h := Hello{Version: ProtocolVersion, Name: e.name}
+	codecsMu.RLock()
+	for name := range codecs {
+		h.Codecs = append(h.Codecs, name)
+	}
+	codecsMu.RUnlock()
+	sort.Strings(h.Codecs)
+	if e.framed {
+		h.Features = append(h.Features, FeatureFraming, FeatureMultiplexing)
+	}
+	if e.tlsConfig != nil {
+		h.Features = append(h.Features, FeatureTLS)
+		if e.tlsConfig.ClientAuth >= tls.VerifyClientCertIfGiven {
+			h.Features = append(h.Features, FeatureAuth)
+		}
+	}
+	return h
+}
+
+// handleHello handles the HELLO command. It records the client's Hello
+// in the session and replies with the endpoint's Hello.
+func (e *Endpoint) handleHello(ctx context.Context, rw *bufio.ReadWriter) error {
+	line, err := rw.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		if isTimeout(err) {
+			return errors.Wrap(err, "Timeout reading HELLO")
+		}
+		return &RemoteError{Code: StatusMalformed, Message: "cannot read HELLO: " + err.Error()}
+	}
+	var peer Hello
+	if err := json.Unmarshal(line, &peer); err != nil {
+		return &RemoteError{Code: StatusMalformed, Message: "cannot parse HELLO: " + err.Error()}
+	}
+	if rerr := checkVersion(peer.Version); rerr != nil {
+		return rerr
+	}
+	LoggerFromContext(ctx).Debug("Hello", "client", peer.Name, "version", peer.Version)
+	sessionFromContext(ctx).setPeer(&peer)
+
+	data, err := json.Marshal(e.hello())
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode HELLO reply")
+	}
+	if _, err := rw.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "Cannot write to connection.")
+	}
+	return errors.Wrap(rw.Flush(), "Flush failed.")
+}
+
+func (s *session) setPeer(h *Hello) {
+	s.mu.Lock()
+	s.peer = h
+	s.mu.Unlock()
+}
+
+// PeerFromContext returns the Hello that the client sent on the
+// handler's connection. It returns false if the client skipped the
+// handshake.
+func PeerFromContext(ctx context.Context) (Hello, bool) {
+	s := sessionFromContext(ctx)
+	if s == nil {
+		return Hello{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peer == nil {
+		return Hello{}, false
+	}
+	return *s.peer, true
+}
+
+// hello describes the Client.
+func (c *Client) hello() Hello {
+	h := Hello{
+		Version:  ProtocolVersion,
+		Name:     c.name,
+		Codecs:   []string{c.getCodec().Name()},
+		Features: []string{FeatureFraming},
+	}
+	if c.multiplexed {
+		h.Features = append(h.Features, FeatureMultiplexing)
+	}
+	if c.tlsConfig != nil {
+		h.Features = append(h.Features, FeatureTLS)
+		if len(c.tlsConfig.Certificates) > 0 {
+			h.Features = append(h.Features, FeatureAuth)
+		}
+	}
+	return h
+}
+
+// handshake exchanges Hellos with the endpoint and negotiates the codec.
+// c.mu must be held, or c must not be shared yet.
+func (c *Client) handshake() error {
+	data, err := json.Marshal(c.hello())
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode HELLO")
+	}
+	reply, err := c.exchange(Frame{Command: helloCommand, Payload: append(data, '\n')})
+	if err != nil {
+		return err
+	}
+	if err := reply.Err(); err != nil {
+		return errors.Wrap(err, "Handshake failed")
+	}
+	var peer Hello
+	if err := json.Unmarshal(reply.Payload, &peer); err != nil {
+		return errors.Wrap(err, "Cannot parse the HELLO reply")
+	}
+	if rerr := checkVersion(peer.Version); rerr != nil {
+		return errors.Wrap(rerr, "Handshake failed")
+	}
+	c.peer = peer
+	return c.negotiateCodec()
+}
+
+// Peer returns the Hello that the endpoint sent on the current
+// connection.
+func (c *Client) Peer() Hello {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer
+}
@@ -0,0 +1,247 @@
+package main
+
+/*
+## Connection limits
+
+Each connection costs a goroutine, buffers, and a file descriptor. Without
+a limit, a flood of clients - or a single misbehaving one - can exhaust
+them. WithMaxConns limits the number of open connections. When the limit
+is reached, the endpoint stops accepting new connections until one closes,
+so that new clients wait in the operating system's listen queue. With
+WithRejectBusy, the endpoint accepts them instead and replies with
+StatusBusy right away. WithMaxConnsPerIP limits the connections from a
+single IP address; excess connections are always rejected with StatusBusy.
+A slow client could hold on to a busy reply, so only a few of them are
+sent at a time. Beyond that, rejected connections are closed without one.
+
+If Accept fails because the process is out of file descriptors or for a
+similar temporary reason, the endpoint waits before trying again, doubling
+the delay up to a second, rather than spinning in a tight loop.
+
+A single request can exhaust memory, too, if it is large enough - or
+claims to be. So a command line in newline mode may not exceed the
+longest command name, and a payload may not exceed WithMaxPayload, 16 MiB
+by default. A frame header that announces a larger payload is answered
+with StatusMalformed, and the connection is closed before the endpoint
+reads or allocates anything. In newline mode, the payload has no length,
+so the endpoint counts the bytes that a command reads, and the handler's
+next read fails when it reads too much. Handlers that decode GOB or JSON
+are bounded that way, too.
+*/
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxPayload is the default limit for the payload of a request.
+const DefaultMaxPayload = 16 << 20
+
+// errTooLarge is returned by reads beyond the limit of a request.
+var errTooLarge = errors.New("request too large")
+
+// errLineTooLong is returned for a command line that is too long.
+var errLineTooLong = errors.New("command line too long")
+
+// maxRejects limits the number of busy replies in flight.
+const maxRejects = 16
+
+// Delays between attempts after a temporary Accept error.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// WithMaxConns limits the number of open connections. The default is no
+// limit.
+func WithMaxConns(n int) Option {
+	return func(e *Endpoint) {
+		if n > 0 {
+			e.connSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithRejectBusy makes the endpoint reject connections beyond the
+// WithMaxConns limit with StatusBusy, rather than leaving them in the
+// listen queue.
+func WithRejectBusy() Option {
+	return func(e *Endpoint) {
+		e.rejectBusy = true
+	}
+}
+
+// WithMaxPayload limits the size of a request's payload. The default is
+// DefaultMaxPayload.
+func WithMaxPayload(n int) Option {
+	return func(e *Endpoint) {
+		if n > 0 {
+			e.maxPayload = n
+		}
+	}
+}
+
+// requestLimit returns the number of bytes that a command may read in
+// newline mode. This includes the command line, and whatever the
+// connection's buffer has read ahead.
+func (e *Endpoint) requestLimit(r *bufio.Reader) int64 {
+	return int64(e.maxPayload) + maxCommandLen + 1 + int64(r.Size())
+}
+
+// limitReader fails once more than n bytes have been read since the
+// last call to reset. A negative n means no limit.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) reset(n int64) {
+	l.n = n
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return l.r.Read(p)
+	}
+	if l.n == 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// readLine reads a line of at most max bytes, including the newline.
+// Unlike ReadString, it gives up as soon as the line is too long.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max {
+			return "", errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// WithMaxConnsPerIP limits the number of open connections from a single
+// IP address. The default is no limit.
+func WithMaxConnsPerIP(n int) Option {
+	return func(e *Endpoint) {
+		e.maxConnsPerIP = n
+	}
+}
+
+// waitForSlot blocks until the number of connections is below the
+// WithMaxConns limit, unless the endpoint rejects busy connections. It
+// reports whether it took a slot, which the caller must release if
+// Accept fails, and returns ok = false if the endpoint shuts down in the
+// meantime.
+func (e *Endpoint) waitForSlot() (took, ok bool) {
+	if e.connSlots == nil || e.rejectBusy {
+		return false, true
+	}
+	select {
+	case e.connSlots <- struct{}{}:
+		return true, true
+	case <-e.baseCtx.Done():
+		return false, false
+	}
+}
+
+// takeSlot claims a slot for a connection that has been accepted. It
+// fails if the endpoint rejects busy connections and no slot is free.
+func (e *Endpoint) takeSlot() bool {
+	if e.connSlots == nil || !e.rejectBusy {
+		return true
+	}
+	select {
+	case e.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSlot frees the slot of a closed or rejected connection.
+func (e *Endpoint) releaseSlot() {
+	if e.connSlots != nil {
+		<-e.connSlots
+	}
+}
+
+// remoteIP returns the IP address of the remote side of conn, or "" if
+// conn does not use IP.
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// reject sends a busy reply to a connection that exceeds a limit in a
+// new goroutine, and closes the connection. If maxRejects replies are in
+// flight already, it closes the connection right away.
+func (e *Endpoint) reject(conn net.Conn, msg string) {
+	select {
+	case e.rejects <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-e.rejects }()
+		e.sendBusy(conn, msg)
+	}()
+}
+
+// sendBusy sends a busy reply and closes the connection.
+func (e *Endpoint) sendBusy(conn net.Conn, msg string) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(errorReplyTimeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	var err error
+	if e.framed {
+		err = writeFlush(rw, errorFrame("", StatusBusy, msg))
+	} else {
+		err = writeErrorLine(rw.Writer, StatusBusy, msg)
+	}
+	if err != nil {
+		e.logger.Warn("Cannot send busy reply", "remote", conn.RemoteAddr().String(), errorAttr(err))
+	}
+}
+
+// temporaryError reports whether an Accept error may go away by itself,
+// like running out of file descriptors.
+func temporaryError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+// acceptDelay returns the delay before the next Accept after a temporary
+// error, given the previous delay.
+func acceptDelay(prev time.Duration) time.Duration {
+	if prev == 0 {
+		return minAcceptDelay
+	}
+	if prev*2 > maxAcceptDelay {
+		return maxAcceptDelay
+	}
+	return prev * 2
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestShutdownRejectBusy checks that Serve returns after Shutdown when
+// the endpoint rejects busy connections, with and without open
+// connections.
+func TestShutdownRejectBusy(t *testing.T) {
+	for _, open := range []int{0, 2} {
+		e := serverEndpoint(WithFraming(), WithMaxConns(2), WithRejectBusy())
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error, 1)
+		go func() { served <- e.Serve(l) }()
+		for e.Addr() == nil {
+			time.Sleep(time.Millisecond)
+		}
+
+		for i := 0; i < open; i++ {
+			c, err := NewClient(l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+		}
+		if open == 2 {
+			// The limit still holds.
+			if _, err := NewClient(l.Addr().String()); err == nil {
+				t.Fatal("Got a third connection, want StatusBusy")
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		go e.Shutdown(ctx)
+		select {
+		case err := <-served:
+			if err != ErrEndpointClosed {
+				t.Fatalf("Serve returned %v, want ErrEndpointClosed", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Serve did not return after Shutdown with %d connections", open)
+		}
+		cancel()
+	}
+}
+
+// TestLargeReply checks that a Client reads a reply beyond
+// DefaultMaxPayload. Only the endpoint limits the requests it reads.
+func TestLargeReply(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), DefaultMaxPayload+1<<20)
+	e := serverEndpoint(WithFraming(), WithMaxPayload(64<<20))
+	e.AddHandler("BIG", func(ctx context.Context, rw *bufio.ReadWriter) error {
+		_, err := rw.Write(big)
+		return err
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Serve(l)
+	defer e.Shutdown(context.Background())
+
+	c, err := NewClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		var reply []byte
+		if err := c.Call(context.Background(), "BIG", nil, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, big) {
+			t.Fatalf("Got a reply of %d bytes, want %d bytes", len(reply), len(big))
+		}
+	}
+}
+
+// TestRejectBusyFlood checks that rejected clients that never read their
+// busy reply do not pile up: beyond maxRejects, connections are closed
+// without one.
+func TestRejectBusyFlood(t *testing.T) {
+	l := NewMemListener()
+	e := serverEndpoint(WithFraming(), WithMaxConns(1), WithRejectBusy())
+	go e.Serve(l)
+	defer e.Shutdown(context.Background())
+	c, err := NewClient("mem", WithDialer(l.Dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The pipes have no buffer, so each busy reply waits for a reader.
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i <= maxRejects; i++ {
+		conn, err := l.Dial("mem")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	conn := conns[maxRejects]
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Got %d bytes and error %v, want a closed connection", n, err)
+	}
+}
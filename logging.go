@@ -0,0 +1,81 @@
+package main
+
+/*
+## Logging
+
+An endpoint in production should not chat about every step. Endpoints and
+Clients log through a *slog.Logger, and they are silent unless they get one
+through WithLogger or WithClientLogger. The records are structured, so
+that they can be filtered and processed: each one carries the connection
+ID and remote address, and, where they apply, the command, the number of
+bytes, the duration, and the error.
+
+The levels are:
+
+* Debug for the normal course of events, like accepting a connection or
+  receiving a command.
+* Info for connections that open and close.
+* Warn for requests that a client got wrong, like unknown commands or
+  payloads that end too early, and for clients that hang up mid-request.
+* Error for failures on the endpoint's side, like failing handlers.
+
+Handlers get a logger with the attributes of their request from
+LoggerFromContext.
+*/
+
+import (
+	"context"
+	"log/slog"
+	"net"
+)
+
+// discardHandler drops all records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// discardLogger is the default logger, which logs nothing.
+var discardLogger = slog.New(discardHandler{})
+
+// WithLogger lets the endpoint log to l. The default is not to log.
+func WithLogger(l *slog.Logger) Option {
+	return func(e *Endpoint) {
+		e.logger = l
+	}
+}
+
+// WithClientLogger lets the Client log to l. The default is not to log.
+func WithClientLogger(l *slog.Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// loggerKey is the context key for the logger of a connection or request.
+type loggerKey struct{}
+
+// LoggerFromContext returns a logger that adds the connection ID, the
+// remote address, and the command to each record. Outside of an
+// endpoint, it returns a logger that logs nothing.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return discardLogger
+}
+
+// connLogger returns the endpoint's logger with the attributes of a
+// connection.
+func (e *Endpoint) connLogger(id uint64, conn net.Conn) *slog.Logger {
+	return e.logger.With(slog.Uint64("conn", id), slog.String("remote", conn.RemoteAddr().String()))
+}
+
+// errorAttr returns an attribute with the message of err. Logging err
+// itself would let the text handler format it with %+v, which prints the
+// whole stack trace of an error from github.com/pkg/errors.
+func errorAttr(err error) slog.Attr {
+	return slog.String("error", err.Error())
+}
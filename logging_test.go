@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// TestLogErrorMessage checks that a failing handler's error is logged by
+// its message, without the stack trace that pkg/errors records.
+func TestLogErrorMessage(t *testing.T) {
+	var buf bytes.Buffer
+	e := serverEndpoint(WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	e.AddHandler("FAIL", func(ctx context.Context, rw *bufio.ReadWriter) error {
+		return errors.New("out of luck")
+	})
+	serveBytes(t, e, []byte("FAIL\n"))
+	if !strings.Contains(buf.String(), `error="out of luck"`) {
+		t.Fatalf("Log lacks the error message:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "logging_test.go") {
+		t.Fatalf("Log contains a stack trace:\n%s", buf.String())
+	}
+}
+
+// TestLogClientHangup checks that a client that hangs up mid-request is
+// not logged as a failure of the endpoint.
+func TestLogClientHangup(t *testing.T) {
+	var buf bytes.Buffer
+	e := serverEndpoint(WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	e.AddHandler("SHORT", func(ctx context.Context, rw *bufio.ReadWriter) error {
+		_, err := io.ReadFull(rw, make([]byte, 10))
+		return errors.Wrap(err, "Cannot read the request")
+	})
+	serveBytes(t, e, []byte("SHORT\nabc"))
+	if !strings.Contains(buf.String(), `level=WARN msg="Command failed"`) {
+		t.Fatalf("Log lacks a warning:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "level=ERROR") {
+		t.Fatalf("Log contains an error:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// startMem serves the server's endpoint on a MemListener and returns a
+// Client connected to it.
+func startMem(t *testing.T, opts ...ClientOption) *Client {
+	l := NewMemListener()
+	e := serverEndpoint(WithFraming())
+	go e.Serve(l)
+	t.Cleanup(func() { e.Shutdown(context.Background()) })
+
+	c, err := NewClient("mem", append([]ClientOption{WithDialer(l.Dial)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestMemString(t *testing.T) {
+	t.Parallel()
+	c := startMem(t)
+	var reply string
+	if err := c.Call(context.Background(), "STRING", "hello\n", &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Thank you.\n" {
+		t.Fatalf("Got %q, want %q", reply, "Thank you.\n")
+	}
+}
+
+func TestMemEcho(t *testing.T) {
+	t.Parallel()
+	for _, mux := range []bool{false, true} {
+		var opts []ClientOption
+		if mux {
+			opts = append(opts, WithMultiplexing())
+		}
+		c := startMem(t, opts...)
+		for i := 0; i < 3; i++ {
+			got, err := Call[complexData, complexData](context.Background(), c, "ECHO", testData())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "Echo: " + testData().S; got.S != want {
+				t.Fatalf("Got %q, want %q", got.S, want)
+			}
+		}
+	}
+}
+
+func TestMemListenerClosed(t *testing.T) {
+	t.Parallel()
+	l := NewMemListener()
+	l.Close()
+	if _, err := NewClient("mem", WithDialer(l.Dial)); err == nil {
+		t.Fatal("Dialed a closed MemListener")
+	}
+}
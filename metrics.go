@@ -0,0 +1,276 @@
+package main
+
+/*
+## Metrics
+
+Logs tell what happened to a single connection. To see how an endpoint
+fares as a whole - how many connections it serves, which commands it
+runs, how long they take, and how often they fail - it reports
+measurements to a Metrics implementation, set WithMetrics.
+
+PrometheusMetrics is a Metrics that keeps counters and histograms in
+memory and renders them in the text format that Prometheus scrapes. It
+is an http.Handler, so it can be served on a port of its own, away from
+the endpoint's protocol:
+
+    m := NewPrometheusMetrics()
+    e := NewEndpoint(WithMetrics(m))
+    go http.ListenAndServe(":9100", m)
+
+Try `-metrics :9100` on the command line, then `curl localhost:9100`.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives measurements from an endpoint. The methods are called
+// concurrently and should return quickly.
+type Metrics interface {
+	// ConnOpened and ConnClosed bracket each accepted connection.
+	ConnOpened()
+	ConnClosed()
+	// ConnRejected counts connections that exceed a limit.
+	ConnRejected()
+	// CommandDone is called after each handler, with status 0 if the
+	// handler succeeded.
+	CommandDone(command string, d time.Duration, status StatusCode)
+	// DecodeError counts requests that could not be decoded.
+	DecodeError(command string)
+	// UnknownCommand counts requests for commands that are not
+	// registered.
+	UnknownCommand()
+	// BytesRead and BytesWritten count the bytes that the endpoint
+	// receives and sends.
+	BytesRead(n int)
+	BytesWritten(n int)
+}
+
+// WithMetrics lets the endpoint report to m. The default is to report
+// nothing.
+func WithMetrics(m Metrics) Option {
+	return func(e *Endpoint) {
+		e.metrics = m
+	}
+}
+
+// noMetrics is the default Metrics, which drops all measurements.
+type noMetrics struct{}
+
+func (noMetrics) ConnOpened()                                   {}
+func (noMetrics) ConnClosed()                                   {}
+func (noMetrics) ConnRejected()                                 {}
+func (noMetrics) CommandDone(string, time.Duration, StatusCode) {}
+func (noMetrics) DecodeError(string)                            {}
+func (noMetrics) UnknownCommand()                               {}
+func (noMetrics) BytesRead(int)                                 {}
+func (noMetrics) BytesWritten(int)                              {}
+
+// countingConn reports the bytes that pass through a connection.
+type countingConn struct {
+	net.Conn
+	m Metrics
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.m.BytesRead(n)
+	}
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.m.BytesWritten(n)
+	}
+	return n, err
+}
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the
+// histogram buckets for handler latency.
+var DefaultLatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// commandKey identifies a command counter.
+type commandKey struct {
+	command string
+	status  StatusCode
+}
+
+// PrometheusMetrics collects an endpoint's metrics and serves them in
+// the Prometheus text exposition format.
+type PrometheusMetrics struct {
+	buckets []float64
+
+	accepted, active, rejected, unknown, bytesIn, bytesOut atomic.Int64
+
+	mu           sync.Mutex
+	commands     map[commandKey]uint64
+	latency      map[string]*histogram
+	decodeErrors map[string]uint64
+}
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics. The latency
+// histograms use the given buckets, in seconds, or DefaultLatencyBuckets
+// if there are none.
+func NewPrometheusMetrics(buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusMetrics{
+		buckets:      buckets,
+		commands:     map[commandKey]uint64{},
+		latency:      map[string]*histogram{},
+		decodeErrors: map[string]uint64{},
+	}
+}
+
+// ConnOpened counts an accepted connection, which is open until
+// ConnClosed.
+func (m *PrometheusMetrics) ConnOpened() {
+	m.accepted.Add(1)
+	m.active.Add(1)
+}
+
+// ConnClosed counts a closed connection.
+func (m *PrometheusMetrics) ConnClosed() { m.active.Add(-1) }
+
+// ConnRejected counts a connection that exceeds a limit.
+func (m *PrometheusMetrics) ConnRejected() { m.rejected.Add(1) }
+
+// UnknownCommand counts a request for an unregistered command.
+func (m *PrometheusMetrics) UnknownCommand() { m.unknown.Add(1) }
+
+// BytesRead counts received bytes.
+func (m *PrometheusMetrics) BytesRead(n int) { m.bytesIn.Add(int64(n)) }
+
+// BytesWritten counts sent bytes.
+func (m *PrometheusMetrics) BytesWritten(n int) { m.bytesOut.Add(int64(n)) }
+
+// CommandDone counts a command by name and status, and adds its duration
+// to the command's latency histogram.
+func (m *PrometheusMetrics) CommandDone(command string, d time.Duration, status StatusCode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands[commandKey{command, status}]++
+	h, ok := m.latency[command]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.latency[command] = h
+	}
+	s := d.Seconds()
+	if i := sort.SearchFloat64s(m.buckets, s); i < len(m.buckets) {
+		h.counts[i]++
+	}
+	h.sum += s
+	h.count++
+}
+
+// DecodeError counts a request that could not be decoded.
+func (m *PrometheusMetrics) DecodeError(command string) {
+	m.mu.Lock()
+	m.decodeErrors[command]++
+	m.mu.Unlock()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// WriteText writes the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("networking_connections_accepted_total", "Connections accepted.", m.accepted.Load())
+	fmt.Fprintf(bw, "# HELP networking_connections_active Connections open.\n# TYPE networking_connections_active gauge\nnetworking_connections_active %d\n",
+		m.active.Load())
+	counter("networking_connections_rejected_total", "Connections rejected because of a limit.", m.rejected.Load())
+	counter("networking_unknown_commands_total", "Requests for unregistered commands.", m.unknown.Load())
+	counter("networking_received_bytes_total", "Bytes received.", m.bytesIn.Load())
+	counter("networking_sent_bytes_total", "Bytes sent.", m.bytesOut.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]commandKey, 0, len(m.commands))
+	for k := range m.commands {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].command != keys[j].command {
+			return keys[i].command < keys[j].command
+		}
+		return keys[i].status < keys[j].status
+	})
+	fmt.Fprint(bw, "# HELP networking_commands_total Commands handled, by command and status.\n# TYPE networking_commands_total counter\n")
+	for _, k := range keys {
+		status := "ok"
+		if k.status != 0 {
+			status = k.status.String()
+		}
+		fmt.Fprintf(bw, "networking_commands_total{command=\"%s\",status=\"%s\"} %d\n",
+			escapeLabel(k.command), escapeLabel(status), m.commands[k])
+	}
+
+	fmt.Fprint(bw, "# HELP networking_decode_errors_total Requests that could not be decoded, by command.\n# TYPE networking_decode_errors_total counter\n")
+	for _, name := range sortedKeys(m.decodeErrors) {
+		fmt.Fprintf(bw, "networking_decode_errors_total{command=\"%s\"} %d\n", escapeLabel(name), m.decodeErrors[name])
+	}
+
+	fmt.Fprint(bw, "# HELP networking_command_duration_seconds Handler latency, by command.\n# TYPE networking_command_duration_seconds histogram\n")
+	for _, name := range sortedKeys(m.latency) {
+		h := m.latency[name]
+		label := escapeLabel(name)
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(bw, "networking_command_duration_seconds_bucket{command=\"%s\",le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "networking_command_duration_seconds_bucket{command=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(bw, "networking_command_duration_seconds_sum{command=\"%s\"} %s\n", label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "networking_command_duration_seconds_count{command=\"%s\"} %d\n", label, h.count)
+	}
+	return bw.Flush()
+}
+
+// labelEscaper escapes label values as the text format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// sortedKeys returns the keys of a map, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/appliedgo/networking/endpointtest"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	h := endpointtest.Start(t, serverEndpoint(WithFraming(), WithMetrics(m)))
+	c := h.Client()
+	endpointtest.AssertReply(t, c.Call("STRING", []byte("hello\n")), []byte("Thank you.\n"))
+	endpointtest.AssertError(t, c.Call("NOPE", nil), uint16(StatusUnknownCommand))
+
+	var buf bytes.Buffer
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"networking_connections_accepted_total 1\n",
+		"networking_connections_active 1\n",
+		"networking_unknown_commands_total 1\n",
+		`networking_commands_total{command="STRING",status="ok"} 1` + "\n",
+		`networking_command_duration_seconds_count{command="STRING"} 1` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Metrics lack %q:\n%s", want, buf.String())
+		}
+	}
+}
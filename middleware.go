@@ -0,0 +1,78 @@
+package main
+
+/*
+## Middleware
+
+Some things should happen for every command: logging, timing, checking
+who is calling. Instead of copying them into each handler, a Middleware
+wraps a handler. It runs code before and after calling the wrapped handler,
+can look at the command name and the connection through RequestInfo, sees
+the handler's result, and can even decide not to call the handler at all.
+
+Endpoint.Use adds middleware for all commands, and WithMiddleware adds
+middleware for a single command. Endpoint middleware runs first.
+*/
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Middleware wraps a Handler in another Handler.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware for all commands, including the built-in ones and
+// those that are already registered. The first middleware is the
+// outermost one, which sees the request first and the result last.
+func (e *Endpoint) Use(mw ...Middleware) {
+	e.m.Lock()
+	e.middleware = append(e.middleware, mw...)
+	e.m.Unlock()
+}
+
+// WithMiddleware adds middleware for a single command. It runs inside
+// the endpoint's middleware.
+func WithMiddleware(mw ...Middleware) HandlerOption {
+	return func(cmd *command) {
+		cmd.middleware = append(cmd.middleware, mw...)
+	}
+}
+
+// chain wraps h in mw, so that mw[0] is the outermost middleware.
+func chain(h Handler, mw []Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// wrap returns the command's handler wrapped in the command's and the
+// endpoint's middleware.
+func (e *Endpoint) wrap(cmd *command) Handler {
+	e.m.RLock()
+	mw := e.middleware
+	e.m.RUnlock()
+	return chain(chain(cmd.h, cmd.middleware), mw)
+}
+
+// slowCommand is the duration beyond which logTiming logs a command at
+// Info rather than Debug level.
+const slowCommand = time.Second
+
+// logTiming is a middleware that logs how long each command takes. Only
+// slow commands show up at the default level.
+func logTiming(next Handler) Handler {
+	return func(ctx context.Context, rw *bufio.ReadWriter) error {
+		start := time.Now()
+		err := next(ctx, rw)
+		d := time.Since(start)
+		level := slog.LevelDebug
+		if d > slowCommand {
+			level = slog.LevelInfo
+		}
+		LoggerFromContext(ctx).Log(ctx, level, "Command done", "duration", d)
+		return err
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+/*
+## Concurrent requests
+
+So far, a connection serves one request at a time, and a slow handler
+blocks everything behind it. To avoid this, a client can give each request
+a non-zero ID. The endpoint reads the whole payload of such a request and
+runs the handler in a goroutine of its own, while it goes on reading the
+next frame. Each reply carries the ID of its request, so replies may
+arrive in any order. A per-connection limit keeps a single client from
+starting an unbounded number of goroutines; when the limit is reached, the
+endpoint stops reading until a handler finishes.
+
+Requests with ID 0 are still processed one after the other, in the
+reading goroutine.
+
+On the client side, WithMultiplexing lets a Client send many requests
+without waiting for the replies. A goroutine reads the replies and hands
+each one to the caller waiting for its ID.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMaxConcurrent is the default number of concurrent requests per
+// connection.
+const defaultMaxConcurrent = 16
+
+// WithMaxConcurrent limits the number of requests with an ID that run
+// at the same time on a single connection. The default is 16.
+func WithMaxConcurrent(n int) Option {
+	return func(e *Endpoint) {
+		e.maxConcurrent = n
+	}
+}
+
+// frameConn is the state of a framed connection that the reading
+// goroutine shares with the handlers of concurrent requests.
+type frameConn struct {
+	e      *Endpoint
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	logger *slog.Logger
+
+	// sem limits the number of concurrent requests.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	// writeMu serializes reply frames.
+	writeMu sync.Mutex
+
+	// mu guards inflight and waiting. The connection is idle if no
+	// handler runs and the reading goroutine waits for the next frame.
+	mu       sync.Mutex
+	inflight int
+	waiting  bool
+}
+
+func (e *Endpoint) newFrameConn(ctx context.Context, conn net.Conn, rw *bufio.ReadWriter) *frameConn {
+	n := e.maxConcurrent
+	if n <= 0 {
+		n = defaultMaxConcurrent
+	}
+	return &frameConn{e: e, conn: conn, rw: rw, logger: LoggerFromContext(ctx), sem: make(chan struct{}, n)}
+}
+
+// waitForFrame prepares the connection for reading the next frame
+// header. Only if no handler runs does the connection become idle and
+// the idle timeout apply. waitForFrame fails if the connection would
+// become idle while the endpoint is shutting down.
+func (fc *frameConn) waitForFrame() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.waiting = true
+	if fc.inflight > 0 {
+		fc.conn.SetReadDeadline(time.Time{})
+		return true
+	}
+	if !fc.e.setConnState(fc.conn, connIdle) {
+		return false
+	}
+	fc.e.setIdleDeadline(fc.conn)
+	return true
+}
+
+// gotFrame records that a frame header has arrived.
+func (fc *frameConn) gotFrame() {
+	fc.mu.Lock()
+	fc.waiting = false
+	fc.mu.Unlock()
+}
+
+// finish records the end of a concurrent request. If it was the last
+// one, and the reading goroutine waits for a frame, the connection
+// becomes idle - or gets closed if the endpoint is shutting down.
+func (fc *frameConn) finish() {
+	defer fc.wg.Done()
+	<-fc.sem
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.inflight--
+	if fc.inflight > 0 || !fc.waiting {
+		return
+	}
+	if !fc.e.setConnState(fc.conn, connIdle) {
+		fc.conn.Close()
+		return
+	}
+	fc.e.setIdleDeadline(fc.conn)
+}
+
+// send writes a reply frame.
+func (fc *frameConn) send(f Frame) error {
+	fc.writeMu.Lock()
+	defer fc.writeMu.Unlock()
+	fc.e.setReplyDeadline(fc.conn)
+	return writeFlush(fc.rw, f)
+}
+
+// replyTimeout makes a last attempt to tell the client about a timeout
+// before the connection gets closed.
+func (fc *frameConn) replyTimeout(id uint32, cmd, msg string) {
+	fc.writeMu.Lock()
+	defer fc.writeMu.Unlock()
+	fc.conn.SetWriteDeadline(time.Now().Add(errorReplyTimeout))
+	f := errorFrame(cmd, StatusTimeout, msg)
+	f.ID = id
+	if err := writeFlush(fc.rw, f); err != nil {
+		fc.logger.Warn("Cannot send error reply", errorAttr(err))
+	}
+}
+
+// serveConcurrent reads the payload of a request with an ID and runs the
+// handler in a new goroutine. It returns false if the connection must be
+// closed.
+func (e *Endpoint) serveConcurrent(ctx context.Context, fc *frameConn, hdr frameHeader, cmd *command) bool {
+	select {
+	case fc.sem <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	payload, err := readPayload(fc.rw, hdr.length)
+	if err != nil {
+		<-fc.sem
+		fc.logger.Warn("Cannot read the payload", "command", hdr.command, "id", hdr.id, errorAttr(err))
+		if isTimeout(err) {
+			fc.replyTimeout(hdr.id, hdr.command, "timeout reading the payload")
+		}
+		return false
+	}
+	fc.mu.Lock()
+	fc.inflight++
+	fc.mu.Unlock()
+	fc.wg.Add(1)
+
+	go func() {
+		defer fc.finish()
+		var buf bytes.Buffer
+		frw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(payload)), bufio.NewWriter(&buf))
+		rerr := e.runHandler(ctx, hdr.id, hdr.command, cmd, frw)
+		if rerr == nil {
+			rerr = flushReply(frw)
+		}
+		if hdr.flags&FlagOneWay != 0 {
+			if rerr != nil {
+				fc.logger.Debug("One-way command failed", "command", hdr.command, "id", hdr.id, errorAttr(rerr))
+			}
+			return
+		}
+		reply := Frame{Flags: FlagReply, Command: hdr.command, Payload: buf.Bytes()}
+		if rerr != nil {
+			reply = errorFrame(hdr.command, rerr.Code, rerr.Message)
+		}
+		reply.ID = hdr.id
+		if err := fc.send(reply); err != nil {
+			fc.logger.Warn("Cannot send the reply", "command", hdr.command, "id", hdr.id, errorAttr(err))
+			fc.conn.Close()
+			return
+		}
+		if rerr != nil && e.closesConnection(rerr.Code) {
+			fc.logger.Info("Close the connection", "status", rerr.Code.String())
+			fc.conn.Close()
+		}
+	}()
+	return true
+}
+
+// WithMultiplexing lets the Client send requests with IDs, so that
+// concurrent calls share the connection without waiting for each other.
+// The endpoint runs them concurrently, too, up to its limit.
+//
+// A multiplexed Client encodes each request and decodes each reply with
+// a new encoder or decoder.
+func WithMultiplexing() ClientOption {
+	return func(c *Client) {
+		c.multiplexed = true
+	}
+}
+
+// muxConn tracks the pending calls on a multiplexed connection.
+type muxConn struct {
+	// pending maps request IDs to the channels of waiting callers.
+	pending map[uint32]chan Frame
+	// err is set, and pending is nil, once the connection is broken.
+	err error
+}
+
+// startMux starts reading replies from a new connection. c.mu must be
+// held, or c must not be shared yet.
+func (c *Client) startMux() {
+	mc := &muxConn{pending: map[uint32]chan Frame{}}
+	c.mux = mc
+	go c.readReplies(c.rw.Reader, mc)
+}
+
+// readReplies passes each reply to the caller that waits for it, until
+// the connection breaks.
+func (c *Client) readReplies(r *bufio.Reader, mc *muxConn) {
+	for {
+		f, err := ReadFrame(r)
+		c.mu.Lock()
+		if err != nil {
+			c.breakMux(mc, err)
+			c.mu.Unlock()
+			return
+		}
+		if f.ID == 0 && f.Err() != nil {
+			// An error that concerns the whole connection, such as
+			// an idle timeout. The endpoint closes the connection.
+			c.breakMux(mc, f.Err())
+			c.mu.Unlock()
+			return
+		}
+		ch, ok := mc.pending[f.ID]
+		delete(mc.pending, f.ID)
+		c.mu.Unlock()
+		if !ok {
+			c.logger.Debug("Drop a reply that nobody waits for", "command", f.Command, "id", f.ID)
+			continue
+		}
+		ch <- f
+	}
+}
+
+// breakMux marks a multiplexed connection as broken and wakes up all
+// callers that wait for a reply. c.mu must be held.
+func (c *Client) breakMux(mc *muxConn, err error) {
+	if mc.err != nil {
+		return
+	}
+	mc.err = errors.Wrap(err, "Connection to "+c.addr+" is broken")
+	for _, ch := range mc.pending {
+		close(ch)
+	}
+	mc.pending = nil
+	if c.mux == mc && c.err == nil {
+		c.err = mc.err
+		c.conn.Close()
+	}
+}
+
+// muxRoundTrip is roundTrip for multiplexed Clients. c.mu is only held
+// while sending, so other calls can proceed while this one waits for its
+// reply. If the context ends first, the reply is dropped when it arrives.
+func (c *Client) muxRoundTrip(ctx context.Context, cmd string, flags byte, encode func() ([]byte, error), decode func([]byte) error) error {
+	for attempt := 0; ; attempt++ {
+		mc, id, ch, err := c.muxSend(ctx, cmd, flags, encode)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			return nil
+		}
+		select {
+		case reply, ok := <-ch:
+			if ok {
+				if err := reply.Err(); err != nil {
+					return err
+				}
+				if decode == nil {
+					return nil
+				}
+				return decode(reply.Payload)
+			}
+		case <-ctx.Done():
+			c.mu.Lock()
+			delete(mc.pending, id)
+			c.mu.Unlock()
+			return ctx.Err()
+		case <-c.closing:
+			return ErrClientClosed
+		}
+
+		select {
+		case <-c.closing:
+			return ErrClientClosed
+		default:
+		}
+		c.mu.Lock()
+		err = mc.err
+		c.mu.Unlock()
+		if c.reconnect == nil || attempt > 0 || !c.reconnect.idempotent(cmd) {
+			return err
+		}
+		c.logger.Info("Resend idempotent request", "command", cmd)
+	}
+}
+
+// muxSend sends a request with a new ID. Unless the request is one-way,
+// it returns the channel that receives the reply. If sending fails, the
+// connection breaks, and the channel is closed just like for the callers
+// that already wait for a reply.
+func (c *Client) muxSend(ctx context.Context, cmd string, flags byte, encode func() ([]byte, error)) (*muxConn, uint32, chan Frame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ensureConn(ctx); err != nil {
+		return nil, 0, nil, err
+	}
+	payload, err := encode()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	f := Frame{Flags: flags, ID: c.nextID, Command: cmd, Payload: payload}
+	mc := c.mux
+	ch := make(chan Frame, 1)
+	mc.pending[f.ID] = ch
+
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+	if err := writeFlush(c.rw, f); err != nil {
+		c.breakMux(mc, errors.Wrap(err, "Could not send the "+cmd+" request"))
+		return mc, f.ID, ch, nil
+	}
+	if flags&FlagOneWay != 0 {
+		delete(mc.pending, f.ID)
+		return mc, f.ID, nil, nil
+	}
+	return mc, f.ID, ch, nil
+}
@@ -161,9 +161,10 @@ Note that the deadlines are fixed points in (wallclock) time. Unlike timeouts,
 they don't reset after a new activity. Each activity on the connection must
 therefore set a new deadline.
 
-The sample code below uses no deadlines, as it is simple enough so that we can
-easily see when things get stuck. `Ctrl-C` is our manual "deadline trigger
-tool".
+The sample code below uses no deadlines by default, as it is simple enough so
+that we can easily see when things get stuck. `Ctrl-C` is our manual "deadline
+trigger tool". (For production use, the endpoint can enforce idle, read, and
+write timeouts; see timeouts.go.)
 
 
 ### On the receiving side
@@ -244,12 +245,21 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -267,10 +277,18 @@ type complexData struct {
 }
 
 const (
-	// Port is the port number that the server listens to.
+	// Port is the port number that the server listens to unless
+	// configured otherwise.
 	Port = ":61000"
+
+	// shutdownTimeout is how long the server waits for running handlers
+	// after Ctrl-C.
+	shutdownTimeout = 10 * time.Second
 )
 
+// ErrEndpointClosed is returned by Listen after Shutdown has been called.
+var ErrEndpointClosed = errors.New("endpoint closed")
+
 /*
 ## Outgoing connections
 
@@ -279,19 +297,39 @@ and `io.Writer` interfaces, so we can treat a TCP connection just like any other
 `Reader` or `Writer`.
 */
 
-// Open connects to a TCP Address.
-// It returns a TCP connection armed with a timeout and wrapped into a
+// Open connects to a TCP Address, or to a Unix socket (see unix.go).
+// It returns a connection armed with a timeout and wrapped into a
 // buffered ReadWriter.
 func Open(addr string) (*bufio.ReadWriter, error) {
+	_, rw, err := open(addr, nil)
+	return rw, err
+}
+
+// open does the work for Open and OpenTLS and also returns the connection
+// itself, for callers that need to set deadlines or close the connection.
+// If tlsConfig is nil, the connection is not encrypted.
+func open(addr string, tlsConfig *tls.Config) (net.Conn, *bufio.ReadWriter, error) {
+	return openContext(context.Background(), addr, tlsConfig)
+}
+
+// openContext works like open but gives up when ctx ends.
+func openContext(ctx context.Context, addr string, tlsConfig *tls.Config) (net.Conn, *bufio.ReadWriter, error) {
 	// Dial the remote process.
 	// Note that the local port is chosen on the fly. If the local port
-	// must be a specific one, use DialTCP() instead.
-	log.Println("Dial " + addr)
-	conn, err := net.Dial("tcp", addr)
+	// must be a specific one, set the Dialer's LocalAddr.
+	network, address := splitNetwork(addr)
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: tlsConfig}).DialContext(ctx, network, address)
+	} else {
+		conn, err = d.DialContext(ctx, network, address)
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "Dialing "+addr+" failed")
+		return nil, nil, errors.Wrap(err, "Dialing "+addr+" failed")
 	}
-	return bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
 }
 
 /*
@@ -316,84 +354,450 @@ type HandleFunc func(*bufio.ReadWriter)
 // Endpoint provides an endpoint to other processess
 // that they can send data to.
 type Endpoint struct {
-	listener net.Listener
-	handler  map[string]HandleFunc
+	// nextConnID is the ID of the last connection, and panics counts
+	// recovered panics.
+	nextConnID atomic.Uint64
+	panics     atomic.Uint64
+
+	name           string
+	network        string
+	address        string
+	framed         bool
+	maxConcurrent  int
+	maxPayload     int
+	handlerTimeout time.Duration
+	closeOnPanic   bool
+	idleTimeout    time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	tlsConfig      *tls.Config
+	socketMode     os.FileMode
+	codec          Codec
+	listener       net.Listener
+	handler        map[string]*command
+	// middleware wraps all handlers. See middleware.go.
+	middleware []Middleware
+	// logger receives the endpoint's log records. See logging.go.
+	logger *slog.Logger
+	// metrics receives the endpoint's measurements. See metrics.go.
+	metrics Metrics
 
 	// Maps are not threadsafe, so we need a mutex to control access.
 	m sync.RWMutex
+
+	// The open connections and whether they are idle or busy running a
+	// handler. Shutdown closes idle connections right away and waits
+	// for the busy ones.
+	conns      map[net.Conn]connState
+	connMu     sync.Mutex
+	inShutdown bool
+	wg         sync.WaitGroup
+
+	// Connection limits; see limits.go. connSlots holds a token for each
+	// open connection, and rejects one for each busy reply in flight.
+	// connsPerIP is guarded by connMu.
+	connSlots     chan struct{}
+	rejects       chan struct{}
+	rejectBusy    bool
+	maxConnsPerIP int
+	connsPerIP    map[string]int
+
+	// baseCtx is the parent of all handler contexts. Shutdown cancels it.
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+}
+
+// connState tells whether a connection waits for the next command
+// or is currently processing one.
+type connState int
+
+const (
+	connIdle connState = iota
+	connActive
+)
+
+// Option configures an Endpoint.
+type Option func(*Endpoint)
+
+// WithAddress sets the local address to listen on, for example
+// "localhost:8000", ":0" for a random free port, or a file path
+// or "@name" for Unix sockets. The default is Port.
+func WithAddress(addr string) Option {
+	return func(e *Endpoint) {
+		e.address = addr
+	}
 }
 
-// NewEndpoint creates a new endpoint. To keep things simple,
-// the endpoint listens on a fixed port number.
-func NewEndpoint() *Endpoint {
+// WithNetwork sets the network to listen on. Valid networks are
+// "tcp", "tcp4", "tcp6", and "unix". The default is "tcp".
+func WithNetwork(network string) Option {
+	return func(e *Endpoint) {
+		e.network = network
+	}
+}
+
+// NewEndpoint creates a new endpoint. Without any options, the endpoint
+// listens on Port on all interfaces.
+func NewEndpoint(opts ...Option) *Endpoint {
 	// Create a new Endpoint with an empty list of handler funcs.
-	return &Endpoint{
-		handler: map[string]HandleFunc{},
+	e := &Endpoint{
+		network:    "tcp",
+		address:    Port,
+		handler:    map[string]*command{},
+		conns:      map[net.Conn]connState{},
+		connsPerIP: map[string]int{},
+		codec:      GobCodec{},
+		logger:     discardLogger,
+		metrics:    noMetrics{},
+		maxPayload: DefaultMaxPayload,
+		rejects:    make(chan struct{}, maxRejects),
+	}
+	e.AddHandler(helloCommand, e.handleHello,
+		WithDescription("Handshake. Payload: a line of JSON with version, name, codecs, and features."))
+	e.AddHandler(codecCommand, handleCodec,
+		WithDescription("Switch the connection's codec. Payload: a line with the codec name."))
+	e.AddHandler(listCommand, e.handleList,
+		WithDescription("List the command names as a line of JSON."))
+	e.AddHandler(helpCommand, e.handleHelp,
+		WithDescription("Describe all commands, or the one named in the payload line, as a line of JSON."))
+	e.baseCtx, e.cancelBase = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(e)
 	}
+	return e
 }
 
 // AddHandleFunc adds a new function for handling incoming data.
-func (e *Endpoint) AddHandleFunc(name string, f HandleFunc) {
-	e.m.Lock()
-	e.handler[name] = f
-	e.m.Unlock()
+// See AddHandler for handlers that need a context or can fail.
+func (e *Endpoint) AddHandleFunc(name string, f HandleFunc, opts ...HandlerOption) {
+	e.AddHandler(name, func(_ context.Context, rw *bufio.ReadWriter) error {
+		f(rw)
+		return nil
+	}, opts...)
 }
 
-// Listen starts listening on the endpoint port on all interfaces.
+// Listen starts listening on the endpoint's network and address.
 // At least one handler function must have been added
 // through AddHandleFunc() before.
+// Listen blocks until Shutdown is called and then returns ErrEndpointClosed.
 func (e *Endpoint) Listen() error {
+	switch e.network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return errors.Errorf("Unsupported network %q", e.network)
+	}
+	var listener net.Listener
 	var err error
-	e.listener, err = net.Listen("tcp", Port)
+	if e.network == "unix" {
+		listener, err = e.listenUnix()
+	} else {
+		listener, err = net.Listen(e.network, e.address)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "Unable to listen on port %s\n", Port)
+		return errors.Wrapf(err, "Unable to listen on %s address %s\n", e.network, e.address)
+	}
+	return e.Serve(listener)
+}
+
+// Serve accepts incoming connections on the given listener and handles
+// them in separate goroutines. Serve takes ownership of the listener
+// and closes it on Shutdown. If the endpoint has a TLS configuration,
+// Serve wraps the listener in a TLS listener.
+func (e *Endpoint) Serve(listener net.Listener) error {
+	if e.tlsConfig != nil {
+		listener = tls.NewListener(listener, e.tlsConfig)
+	}
+	e.connMu.Lock()
+	if e.inShutdown {
+		e.connMu.Unlock()
+		listener.Close()
+		return ErrEndpointClosed
 	}
-	log.Println("Listen on", e.listener.Addr().String())
+	e.listener = listener
+	e.connMu.Unlock()
+
+	e.logger.Info("Listen", "addr", listener.Addr().String())
+	var delay time.Duration
 	for {
-		log.Println("Accept a connection request.")
-		conn, err := e.listener.Accept()
+		took, ok := e.waitForSlot()
+		if !ok {
+			return ErrEndpointClosed
+		}
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Failed accepting a connection request:", err)
+			if took {
+				e.releaseSlot()
+			}
+			if e.shuttingDown() {
+				return ErrEndpointClosed
+			}
+			if !temporaryError(err) {
+				return errors.Wrap(err, "Failed accepting a connection request")
+			}
+			delay = acceptDelay(delay)
+			e.logger.Warn("Failed accepting a connection request", errorAttr(err), "retry_in", delay)
+			select {
+			case <-time.After(delay):
+			case <-e.baseCtx.Done():
+				return ErrEndpointClosed
+			}
+			continue
+		}
+		delay = 0
+		if !e.takeSlot() {
+			e.logger.Warn("Reject connection", "remote", conn.RemoteAddr().String(), "reason", "too many connections")
+			e.metrics.ConnRejected()
+			e.reject(conn, "too many connections")
 			continue
 		}
-		log.Println("Handle incoming messages.")
+		if err := e.trackConn(conn); err != nil {
+			e.releaseSlot()
+			var rerr *RemoteError
+			if errors.As(err, &rerr) {
+				e.logger.Warn("Reject connection", "remote", conn.RemoteAddr().String(), "reason", rerr.Message)
+				e.metrics.ConnRejected()
+				e.reject(conn, rerr.Message)
+				continue
+			}
+			conn.Close()
+			return err
+		}
+		e.logger.Debug("Accept connection", "remote", conn.RemoteAddr().String())
 		go e.handleMessages(conn)
 	}
 }
 
+// Addr returns the address the endpoint listens on, or nil if it is
+// not listening. This is useful for reading back the actual port after
+// listening on ":0".
+func (e *Endpoint) Addr() net.Addr {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	if e.listener == nil {
+		return nil
+	}
+	return e.listener.Addr()
+}
+
+// ListenContext works like Listen but shuts the endpoint down when ctx
+// is cancelled. It returns nil after all connections have been closed.
+func (e *Endpoint) ListenContext(ctx context.Context) error {
+	shutdown := make(chan error, 1)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdown <- e.Shutdown(context.Background())
+		case <-stop:
+			shutdown <- nil
+		}
+	}()
+	err := e.Listen()
+	close(stop)
+	if err == ErrEndpointClosed && ctx.Err() != nil {
+		return <-shutdown
+	}
+	return err
+}
+
+// Shutdown stops the endpoint gracefully. It closes the listener and all
+// idle connections, cancels the handlers' contexts, and then waits until
+// the running handlers have finished. If ctx expires first, Shutdown
+// closes the remaining connections forcibly and returns the context's error.
+func (e *Endpoint) Shutdown(ctx context.Context) error {
+	e.cancelBase()
+	e.connMu.Lock()
+	e.inShutdown = true
+	var err error
+	if e.listener != nil {
+		err = e.listener.Close()
+		e.listener = nil
+	}
+	for conn, state := range e.conns {
+		if state == connIdle {
+			conn.Close()
+		}
+	}
+	e.connMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return errors.Wrap(err, "Closing the listener failed")
+	case <-ctx.Done():
+		e.connMu.Lock()
+		for conn := range e.conns {
+			conn.Close()
+		}
+		e.connMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// shuttingDown reports whether Shutdown has been called.
+func (e *Endpoint) shuttingDown() bool {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	return e.inShutdown
+}
+
+// trackConn registers a new connection. It returns ErrEndpointClosed if
+// the endpoint is already shutting down, or a *RemoteError with
+// StatusBusy if the remote IP address has too many connections.
+func (e *Endpoint) trackConn(conn net.Conn) error {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	if e.inShutdown {
+		return ErrEndpointClosed
+	}
+	if ip := remoteIP(conn); ip != "" && e.maxConnsPerIP > 0 {
+		if e.connsPerIP[ip] >= e.maxConnsPerIP {
+			return &RemoteError{Code: StatusBusy, Message: "too many connections from " + ip}
+		}
+		e.connsPerIP[ip]++
+	}
+	e.conns[conn] = connActive
+	e.wg.Add(1)
+	e.metrics.ConnOpened()
+	return nil
+}
+
+// untrackConn closes a connection and removes it from the list of open
+// connections.
+func (e *Endpoint) untrackConn(conn net.Conn) {
+	conn.Close()
+	e.connMu.Lock()
+	delete(e.conns, conn)
+	if ip := remoteIP(conn); ip != "" && e.maxConnsPerIP > 0 {
+		if e.connsPerIP[ip]--; e.connsPerIP[ip] <= 0 {
+			delete(e.connsPerIP, ip)
+		}
+	}
+	e.connMu.Unlock()
+	e.metrics.ConnClosed()
+	e.releaseSlot()
+	e.wg.Done()
+}
+
+// setConnState records whether a connection is idle or active. Switching
+// to idle fails if the endpoint is shutting down, so that the caller can
+// stop reading further commands.
+func (e *Endpoint) setConnState(conn net.Conn, state connState) bool {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+	if state == connIdle && e.inShutdown {
+		return false
+	}
+	e.conns[conn] = state
+	return true
+}
+
 // handleMessages reads the connection up to the first newline.
 // Based on this string, it calls the appropriate HandleFunc.
 func (e *Endpoint) handleMessages(conn net.Conn) {
 	// Wrap the connection into a buffered reader for easier reading.
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	defer conn.Close()
+	// countingConn reports the traffic to the endpoint's metrics.
+	// In newline mode, limit counts the bytes that each command reads.
+	cc := countingConn{Conn: conn, m: e.metrics}
+	limit := &limitReader{r: cc, n: -1}
+	rw := bufio.NewReadWriter(bufio.NewReader(limit), bufio.NewWriter(cc))
+	defer e.untrackConn(conn)
+	// Panics in handlers are recovered in runHandler. This is the last
+	// line of defense for the rest of the connection's code.
+	defer e.recoverConn(conn)
+
+	// Complete the TLS handshake first, so that handlers can see the
+	// peer's identity. Until then, the connection counts as idle, so that
+	// Shutdown need not wait for a stalled handshake.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if !e.setConnState(conn, connIdle) {
+			return
+		}
+		e.setIdleDeadline(conn)
+		e.setReplyDeadline(conn)
+		if err := tlsConn.Handshake(); err != nil {
+			e.logger.Warn("TLS handshake failed", "remote", conn.RemoteAddr().String(), errorAttr(err))
+			return
+		}
+	}
+	ctx, cancel := e.connContext(conn)
+	defer cancel()
+	logger := LoggerFromContext(ctx)
+	logger.Info("Connection opened")
+	defer logger.Info("Connection closed")
+
+	if e.framed {
+		e.handleFrames(ctx, conn, rw)
+		return
+	}
 
 	// Read from the connection until EOF. Expect a command name as the
 	// next input. Call the handler that is registered for this command.
 	for {
-		log.Print("Receive command '")
-		cmd, err := rw.ReadString('\n')
+		if !e.setConnState(conn, connIdle) {
+			logger.Debug("Endpoint is shutting down")
+			return
+		}
+		e.setIdleDeadline(conn)
+		limit.reset(e.requestLimit(rw.Reader))
+		cmd, err := readLine(rw.Reader, maxCommandLen+1)
 		switch {
 		case err == io.EOF:
-			log.Println("Reached EOF - close this connection.\n   ---")
+			logger.Debug("Reached EOF")
+			return
+		case isTimeout(err):
+			logger.Info("Idle timeout")
+			e.replyError(ctx, conn, rw, StatusTimeout, "idle timeout")
+			return
+		case err == errLineTooLong:
+			logger.Warn("Command line too long")
+			e.replyError(ctx, conn, rw, StatusMalformed, "command line too long")
 			return
 		case err != nil:
-			log.Println("\nError reading command. Got: '"+cmd+"'\n", err)
+			logger.Warn("Cannot read command", errorAttr(err))
 			return
 		}
+		e.setConnState(conn, connActive)
+		// The handler reads the payload and writes the reply directly,
+		// so both deadlines start now.
+		e.setCommandDeadline(conn)
+		e.setReplyDeadline(conn)
 		// Trim the request string - ReadString does not strip any newlines.
 		cmd = strings.Trim(cmd, "\n ")
-		log.Println(cmd + "'")
+		logger.Debug("Receive command", "command", cmd)
+		if cmd == "" {
+			logger.Warn("Empty command")
+			e.replyError(ctx, conn, rw, StatusMalformed, "empty command")
+			return
+		}
 
 		// Fetch the appropriate handler function from the 'handler' map and call it.
-		e.m.RLock()
-		handleCommand, ok := e.handler[cmd]
-		e.m.RUnlock()
+		handleCommand, ok := e.lookup(cmd)
 		if !ok {
-			log.Println("Command '" + cmd + "' is not registered.")
+			logger.Warn("Unknown command", "command", cmd)
+			e.metrics.UnknownCommand()
+			e.replyError(ctx, conn, rw, StatusUnknownCommand, "command "+cmd+" is not registered")
+			return
+		}
+		// If the handler fails, we cannot tell how much of its payload is
+		// left in the stream, so the connection ends here.
+		if rerr := e.runHandler(ctx, 0, cmd, handleCommand, rw); rerr != nil {
+			e.replyError(ctx, conn, rw, rerr.Code, rerr.Message)
 			return
 		}
-		handleCommand(rw)
+	}
+}
+
+// replyError sends an error reply in newline mode. The caller closes the
+// connection afterwards, as the rest of the stream cannot be interpreted.
+func (e *Endpoint) replyError(ctx context.Context, conn net.Conn, rw *bufio.ReadWriter, code StatusCode, msg string) {
+	conn.SetWriteDeadline(time.Now().Add(errorReplyTimeout))
+	if err := writeErrorLine(rw.Writer, code, msg); err != nil {
+		LoggerFromContext(ctx).Warn("Cannot send error reply", errorAttr(err))
 	}
 }
 
@@ -404,41 +808,54 @@ The second handler receives and processes a struct that was sent as GOB data.
 */
 
 // handleStrings handles the "STRING" request.
-func handleStrings(rw *bufio.ReadWriter) {
+func handleStrings(ctx context.Context, rw *bufio.ReadWriter) error {
 	// Receive a string.
-	log.Print("Receive STRING message:")
 	s, err := rw.ReadString('\n')
+	if isTimeout(err) {
+		return errors.Wrap(err, "Timeout reading the string")
+	}
 	if err != nil {
-		log.Println("Cannot read from connection.\n", err)
+		// The request ended before the newline.
+		return &RemoteError{Code: StatusMalformed, Message: "Error reading the string: " + err.Error()}
 	}
 	s = strings.Trim(s, "\n ")
-	log.Println(s)
+	LoggerFromContext(ctx).Info("Receive STRING message", "message", s)
 	_, err = rw.WriteString("Thank you.\n")
 	if err != nil {
-		log.Println("Cannot write to connection.\n", err)
-	}
-	err = rw.Flush()
-	if err != nil {
-		log.Println("Flush failed.", err)
+		return errors.Wrap(err, "Cannot write to connection.")
 	}
+	return errors.Wrap(rw.Flush(), "Flush failed.")
 }
 
 // handleGob handles the "GOB" request. It decodes the received GOB data
-// into a struct.
-func handleGob(rw *bufio.ReadWriter) {
-	log.Print("Receive GOB data:")
+// into a struct. (If the client has switched the connection to another
+// codec, the data arrives in that format instead. See codec.go.)
+func handleGob(ctx context.Context, rw *bufio.ReadWriter) error {
 	var data complexData
-	// Create a decoder that decodes directly into a struct variable.
-	dec := gob.NewDecoder(rw)
+	// Get the connection's decoder, which decodes directly into a struct
+	// variable. It is kept for the next GOB request (see stream.go).
+	dec := RequestDecoder(ctx, rw)
 	err := dec.Decode(&data)
+	if isTimeout(err) {
+		return errors.Wrap(err, "Timeout decoding GOB data")
+	}
 	if err != nil {
-		log.Println("Error decoding GOB data:", err)
-		return
+		return &RemoteError{Code: StatusMalformed, Message: "Error decoding GOB data: " + err.Error()}
 	}
-	// Print the complexData struct and the nested one, too, to prove
+	// Log the complexData struct and the nested one, too, to prove
 	// that both travelled across the wire.
-	log.Printf("Outer complexData struct: \n%#v\n", data)
-	log.Printf("Inner complexData struct: \n%#v\n", data.C)
+	LoggerFromContext(ctx).Info("Receive GOB data",
+		"outer", fmt.Sprintf("%#v", data),
+		"inner", fmt.Sprintf("%#v", data.C))
+	return nil
+}
+
+// handleEcho handles the "ECHO" request. It is registered through Handle,
+// so it receives the decoded struct and returns the reply, and the
+// endpoint takes care of the rest. See typed.go.
+func handleEcho(ctx context.Context, data complexData) (complexData, error) {
+	data.S = "Echo: " + data.S
+	return data, nil
 }
 
 /*
@@ -451,11 +868,10 @@ The client function connects to the server and sends STRING and GOB requests.
 The server starts listening for requests and triggers the appropriate handlers.
 */
 
-// client is called if the app is called with -connect=`ip addr`.
-func client(ip string) error {
-	// Some test data. Note how GOB even handles maps, slices, and
-	// recursive data structures without problems.
-	testStruct := complexData{
+// testData returns some test data. Note how GOB even handles maps, slices,
+// and recursive data structures without problems.
+func testData() complexData {
+	return complexData{
 		N: 23,
 		S: "string data",
 		M: map[string]int{"one": 1, "two": 2, "three": 3},
@@ -466,17 +882,30 @@ func client(ip string) error {
 			M: map[string]int{"01": 1, "10": 2, "11": 3},
 		},
 	}
+}
+
+// client is called if the app is called with -connect=`ip addr`.
+// addr is the server address including the port. If tlsConfig is not nil,
+// the client connects via TLS.
+func client(addr string, tlsConfig *tls.Config) error {
+	testStruct := testData()
 
 	// Open a connection to the server.
-	rw, err := Open(ip + Port)
+	var rw *bufio.ReadWriter
+	var err error
+	if tlsConfig != nil {
+		rw, err = OpenTLS(addr, tlsConfig)
+	} else {
+		rw, err = Open(addr)
+	}
 	if err != nil {
-		return errors.Wrap(err, "Client: Failed to open connection to "+ip+Port)
+		return errors.Wrap(err, "Client: Failed to open connection to "+addr)
 	}
 
 	// Send a STRING request.
 	// Send the request name.
 	// Send the data.
-	log.Println("Send the string request.")
+	slog.Debug("Send the string request.")
 	n, err := rw.WriteString("STRING\n")
 	if err != nil {
 		return errors.Wrap(err, "Could not send the STRING request ("+strconv.Itoa(n)+" bytes written)")
@@ -485,28 +914,31 @@ func client(ip string) error {
 	if err != nil {
 		return errors.Wrap(err, "Could not send additional STRING data ("+strconv.Itoa(n)+" bytes written)")
 	}
-	log.Println("Flush the buffer.")
 	err = rw.Flush()
 	if err != nil {
 		return errors.Wrap(err, "Flush failed.")
 	}
 
 	// Read the reply.
-	log.Println("Read the reply.")
 	response, err := rw.ReadString('\n')
 	if err != nil {
 		return errors.Wrap(err, "Client: Failed to read the reply: '"+response+"'")
 	}
+	// The server might have replied with an error instead.
+	response, err = ParseReplyLine(response)
+	if err != nil {
+		return errors.Wrap(err, "STRING request failed")
+	}
 
-	log.Println("STRING request: got a response:", response)
+	slog.Info("STRING request: got a response", "response", response)
 
 	// Send a GOB request.
 	// Create an encoder that directly transmits to `rw`.
 	// Send the request name.
 	// Send the GOB.
-	log.Println("Send a struct as GOB:")
-	log.Printf("Outer complexData struct: \n%#v\n", testStruct)
-	log.Printf("Inner complexData struct: \n%#v\n", testStruct.C)
+	slog.Info("Send a struct as GOB",
+		"outer", fmt.Sprintf("%#v", testStruct),
+		"inner", fmt.Sprintf("%#v", testStruct.C))
 	enc := gob.NewEncoder(rw)
 	n, err = rw.WriteString("GOB\n")
 	if err != nil {
@@ -524,16 +956,31 @@ func client(ip string) error {
 }
 
 // server listens for incoming requests and dispatches them to
-// registered handler functions.
-func server() error {
-	endpoint := NewEndpoint()
-
-	// Add the handle funcs.
-	endpoint.AddHandleFunc("STRING", handleStrings)
-	endpoint.AddHandleFunc("GOB", handleGob)
+// registered handler functions. When ctx is cancelled, the server stops
+// accepting new connections and waits for running handlers to finish.
+func server(ctx context.Context, opts ...Option) error {
+	endpoint := serverEndpoint(opts...)
 
 	// Start listening.
-	return endpoint.Listen()
+	return endpoint.ListenContext(ctx)
+}
+
+// serverEndpoint creates the server's endpoint and registers the
+// handlers. The tests use it, too.
+func serverEndpoint(opts ...Option) *Endpoint {
+	endpoint := NewEndpoint(opts...)
+	endpoint.Use(logTiming)
+
+	// Add the handle funcs.
+	endpoint.AddHandler("STRING", handleStrings,
+		WithDescription("Reply to a line of text."),
+		WithTypes("", ""))
+	endpoint.AddHandler("GOB", handleGob,
+		WithDescription("Print a struct sent as GOB."),
+		WithTypes(complexData{}, nil))
+	Handle(endpoint, "ECHO", handleEcho,
+		WithDescription("Return the struct with a prefix added to S."))
+	return endpoint
 }
 
 /*
@@ -545,36 +992,168 @@ for incoming requests. With the flag the process starts as a client and connects
 to the host specified by the flag value.
 
 Try "localhost" or "127.0.0.1" when running both processes on the same machine.
+Or use a Unix socket (see unix.go): start the server with
+`-network unix -listen /tmp/networking.sock` and the client with
+`-connect /tmp/networking.sock`.
+
+The `framed` flag switches both client and server to length-prefixed frames
+(see framing.go).
+
+For TLS, create a dev certificate with `-gencert dev`, then start the server
+with `-cert dev.crt -key dev.key` and the client with `-ca dev.crt`. Add
+`-ca dev.crt` to the server and `-cert dev.crt -key dev.key` to the client
+to require client certificates as well.
+
+The `port` flag changes the port for both modes. To run several servers side
+by side, give each one a different port, or use the `listen` flag to set the
+complete listen address.
+
+With the `commands` flag, the client asks the server which commands it
+offers (see discovery.go) instead of sending requests.
 
+The `metrics` flag lets the server publish its metrics for Prometheus on
+a separate HTTP address (see metrics.go).
 */
 
 // main
 func main() {
-	connect := flag.String("connect", "", "IP address of process to join. If empty, go into listen mode.")
+	connect := flag.String("connect", "", "IP address of process to join, or a Unix socket like \"unix:/tmp/networking.sock\". If empty, go into listen mode.")
+	port := flag.String("port", strings.TrimPrefix(Port, ":"), "Port to connect to, or to listen on if -listen is not set.")
+	listen := flag.String("listen", "", "Address to listen on, like \"localhost:8000\" or \"/tmp/networking.sock\". Overrides -port.")
+	network := flag.String("network", "tcp", "Network to listen on: tcp, tcp4, tcp6, or unix.")
+	framed := flag.Bool("framed", false, "Use length-prefixed frames instead of newline-terminated commands.")
+	certFile := flag.String("cert", "", "Certificate file. Enables TLS in listen mode; sent as client certificate in client mode.")
+	keyFile := flag.String("key", "", "Private key file for -cert.")
+	caFile := flag.String("ca", "", "CA certificate file. Requires client certificates in listen mode; enables TLS in client mode.")
+	codec := flag.String("codec", "gob", "Codec for the framed client: gob or json.")
+	commands := flag.Bool("commands", false, "Print the commands that the endpoint at -connect offers, then exit.")
+	mux := flag.Bool("mux", false, "Let the framed client send requests with IDs, so that they can run concurrently.")
+	debug := flag.Bool("debug", false, "Log each step, not just connections, requests, and errors.")
+	metricsAddr := flag.String("metrics", "", "Serve Prometheus metrics over HTTP on this address, like \":9100\", in listen mode.")
+	genCert := flag.String("gencert", "", "Write a self-signed dev certificate for localhost to `prefix`.crt and prefix.key, then exit.")
 	flag.Parse()
 
+	// Log to stderr, as text. The endpoint and the client get this
+	// logger, too; without one, they would not log at all.
+	level := slog.LevelInfo
+	if *debug {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
+	if *genCert != "" {
+		if err := writeDevCert(*genCert); err != nil {
+			slog.Error("Cannot write the certificate", errorAttr(err))
+		}
+		return
+	}
+	var cert *tls.Certificate
+	if *certFile != "" {
+		c, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			slog.Error("Cannot load the certificate", errorAttr(err))
+			return
+		}
+		cert = &c
+	}
+	var ca *x509.CertPool
+	if *caFile != "" {
+		var err error
+		ca, err = LoadCertPool(*caFile)
+		if err != nil {
+			slog.Error("Cannot load the CA certificate", errorAttr(err))
+			return
+		}
+	}
+
 	// If the connect flag is set, go into client mode.
+	// Add the port unless the address already contains one.
 	if *connect != "" {
-		err := client(*connect)
+		addr := *connect
+		if network, _ := splitNetwork(addr); network == "tcp" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, *port)
+			}
+		}
+		var tlsConfig *tls.Config
+		if ca != nil {
+			tlsConfig = ClientTLSConfig(ca, cert)
+		}
+		var err error
+		if *framed {
+			opts := []ClientOption{WithClientLogger(logger)}
+			if tlsConfig != nil {
+				opts = append(opts, WithClientTLS(tlsConfig))
+			}
+			if *mux {
+				opts = append(opts, WithMultiplexing())
+			}
+			if c, ok := lookupCodec(*codec); ok {
+				opts = append(opts, WithClientCodec(c))
+			} else {
+				slog.Error("Unknown codec", "codec", *codec)
+				return
+			}
+			if *commands {
+				err = printCommands(addr, true, tlsConfig, opts...)
+			} else {
+				err = framedClient(addr, opts...)
+			}
+		} else if *commands {
+			err = printCommands(addr, false, tlsConfig)
+		} else {
+			err = client(addr, tlsConfig)
+		}
 		if err != nil {
-			log.Println("Error:", errors.WithStack(err))
+			slog.Error("Client failed", errorAttr(err))
 		}
-		log.Println("Client done.")
+		slog.Info("Client done.")
 		return
 	}
 
-	// Else go into server mode.
-	err := server()
+	// Else go into server mode. Ctrl-C triggers a graceful shutdown;
+	// a second Ctrl-C or a stuck handler ends the process the hard way.
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		slog.Info("Shutting down. Press Ctrl-C again to force.")
+		cancel()
+		select {
+		case <-sig:
+		case <-time.After(shutdownTimeout):
+			slog.Warn("Shutdown timed out.")
+		}
+		os.Exit(1)
+	}()
+	addr := *listen
+	if addr == "" {
+		addr = ":" + *port
+	}
+	opts := []Option{WithNetwork(*network), WithAddress(addr), WithLogger(logger)}
+	if *framed {
+		opts = append(opts, WithFraming())
+	}
+	if cert != nil {
+		opts = append(opts, WithTLS(ServerTLSConfig(*cert, ca)))
+	}
+	if *metricsAddr != "" {
+		m := NewPrometheusMetrics()
+		opts = append(opts, WithMetrics(m))
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, m); err != nil {
+				slog.Error("Cannot serve metrics", errorAttr(err))
+			}
+		}()
+	}
+	err := server(ctx, opts...)
 	if err != nil {
-		log.Println("Error:", errors.WithStack(err))
+		slog.Error("Server failed", errorAttr(err))
 	}
 
-	log.Println("Server done.")
-}
-
-// The Lshortfile flag includes file name and line number in log messages.
-func init() {
-	log.SetFlags(log.Lshortfile)
+	slog.Info("Server done.")
 }
 
 /*
@@ -589,14 +1168,15 @@ Step 2: `cd` to the source code directory.
 
     cd $GOPATH/src/github.com/appliedgo/networking
 
-Step 3. Run the server.
+Step 3. Run the server. The code is spread over a few files now, so run
+the whole package rather than networking.go alone.
 
-    go run networking.go
+    go run .
 
 Step 4. Open another shell, `cd` to the source code (see Step 2), and
 run the client.
 
-    go run networking.go -connect localhost
+    go run . -connect localhost
 
 
 ## Tips
@@ -0,0 +1,34 @@
+//go:build linux
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+)
+
+// peerCred asks the kernel for the credentials of the process on the
+// other side of a Unix socket. It returns nil for other connections.
+func peerCred(conn net.Conn) *PeerCred {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return nil
+	}
+	return &PeerCred{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// peerCred is only implemented on Linux. Elsewhere, it returns nil.
+func peerCred(conn net.Conn) *PeerCred {
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+/*
+## Connection pool
+
+Every Client holds one connection. A program that sends many requests from
+many goroutines would either queue them all on one Client or dial a new
+connection per request. Pool sits in between: it keeps a few connections
+per address open and hands each request an idle one.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPoolClosed is returned by calls on a closed Pool.
+var ErrPoolClosed = errors.New("pool closed")
+
+// PoolConfig sets the limits of a Pool. All limits apply per address.
+type PoolConfig struct {
+	// MinIdle is the number of idle connections that the pool keeps open
+	// for each address it has connected to before.
+	MinIdle int
+	// MaxIdle is the maximum number of idle connections. The default is 2.
+	MaxIdle int
+	// MaxPerAddr limits the number of open connections, idle or busy.
+	// If all are busy, calls wait for one to become free. Zero means
+	// no limit.
+	MaxPerAddr int
+	// IdleTimeout closes connections that have been idle for this long,
+	// unless they are needed to keep MinIdle. The default is 90s.
+	IdleTimeout time.Duration
+	// CheckInterval is the time between two rounds of idle eviction,
+	// health checks, and topping up to MinIdle. The default is 30s.
+	CheckInterval time.Duration
+	// TLS, if set, makes the pool connect via TLS.
+	TLS *tls.Config
+	// Codec, if set, is negotiated on each new connection.
+	Codec Codec
+}
+
+// Pool shares a limited number of connections among many goroutines.
+// Like Client, it requires framed endpoints.
+type Pool struct {
+	cfg PoolConfig
+
+	mu     sync.Mutex
+	addrs  map[string]*poolAddr
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// poolAddr holds the connections to one address.
+type poolAddr struct {
+	idle []idleClient
+	// open counts idle and busy connections, plus dials in progress.
+	open int
+	// waiters receive a connection, or nil if they may dial themselves.
+	// They are closed when the pool shuts down.
+	waiters []chan *Client
+}
+
+// idleClient is a connection waiting in the pool.
+type idleClient struct {
+	c     *Client
+	since time.Time
+}
+
+// NewPool creates a connection pool and starts its maintenance goroutine.
+func NewPool(cfg PoolConfig) *Pool {
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = 2
+	}
+	if cfg.MinIdle > cfg.MaxIdle {
+		cfg.MinIdle = cfg.MaxIdle
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 90 * time.Second
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 30 * time.Second
+	}
+	p := &Pool{
+		cfg:   cfg,
+		addrs: map[string]*poolAddr{},
+		done:  make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.maintain()
+	return p
+}
+
+// Call works like Client.Call on a pooled connection to addr.
+func (p *Pool) Call(ctx context.Context, addr, cmd string, req, resp interface{}) error {
+	c, err := p.get(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer p.put(addr, c)
+	return c.Call(ctx, cmd, req, resp)
+}
+
+// Send works like Client.Send on a pooled connection to addr.
+func (p *Pool) Send(ctx context.Context, addr, cmd string, req interface{}) error {
+	c, err := p.get(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer p.put(addr, c)
+	return c.Send(ctx, cmd, req)
+}
+
+// Close closes all idle connections and stops the maintenance goroutine.
+// Busy connections are closed when their calls return.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	for _, a := range p.addrs {
+		for _, ic := range a.idle {
+			ic.c.Close()
+		}
+		a.open -= len(a.idle)
+		a.idle = nil
+		for _, w := range a.waiters {
+			close(w)
+		}
+		a.waiters = nil
+	}
+	p.mu.Unlock()
+	close(p.done)
+	p.wg.Wait()
+	return nil
+}
+
+// get returns an idle connection to addr, dials a new one, or waits
+// until another call returns one.
+func (p *Pool) get(ctx context.Context, addr string) (*Client, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		a := p.addr(addr)
+		if n := len(a.idle); n > 0 {
+			ic := a.idle[n-1]
+			a.idle = a.idle[:n-1]
+			p.mu.Unlock()
+			if ic.c.healthy() {
+				return ic.c, nil
+			}
+			p.discard(addr, ic.c)
+			continue
+		}
+		if p.cfg.MaxPerAddr <= 0 || a.open < p.cfg.MaxPerAddr {
+			a.open++
+			p.mu.Unlock()
+			return p.dial(ctx, addr)
+		}
+		w := make(chan *Client, 1)
+		a.waiters = append(a.waiters, w)
+		p.mu.Unlock()
+
+		select {
+		case c, ok := <-w:
+			switch {
+			case !ok:
+				return nil, ErrPoolClosed
+			case c == nil:
+				return p.dial(ctx, addr)
+			}
+			return c, nil
+		case <-ctx.Done():
+			p.abandon(addr, w)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// put returns a connection to the pool after a call. Broken connections
+// are closed.
+func (p *Pool) put(addr string, c *Client) {
+	if !c.usable() {
+		p.discard(addr, c)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := p.addr(addr)
+	switch {
+	case p.closed || len(a.idle) >= p.cfg.MaxIdle && len(a.waiters) == 0:
+		c.Close()
+		p.releaseLocked(a)
+	case len(a.waiters) > 0:
+		w := a.waiters[0]
+		a.waiters = a.waiters[1:]
+		w <- c
+	default:
+		a.idle = append(a.idle, idleClient{c: c, since: time.Now()})
+	}
+}
+
+// discard closes a connection and frees its slot.
+func (p *Pool) discard(addr string, c *Client) {
+	c.Close()
+	p.mu.Lock()
+	p.releaseLocked(p.addr(addr))
+	p.mu.Unlock()
+}
+
+// releaseLocked frees a connection slot. If a call is waiting, it gets the
+// slot and may dial. p.mu must be held.
+func (p *Pool) releaseLocked(a *poolAddr) {
+	if len(a.waiters) > 0 {
+		w := a.waiters[0]
+		a.waiters = a.waiters[1:]
+		w <- nil
+		return
+	}
+	a.open--
+}
+
+// abandon removes a waiter whose context has expired. If a connection or
+// a slot was handed over in the meantime, it goes back to the pool.
+func (p *Pool) abandon(addr string, w chan *Client) {
+	p.mu.Lock()
+	a := p.addr(addr)
+	for i, x := range a.waiters {
+		if x == w {
+			a.waiters = append(a.waiters[:i], a.waiters[i+1:]...)
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.mu.Unlock()
+	c, ok := <-w
+	switch {
+	case !ok:
+	case c == nil:
+		p.mu.Lock()
+		p.releaseLocked(a)
+		p.mu.Unlock()
+	default:
+		p.put(addr, c)
+	}
+}
+
+// dial opens a new connection for a slot that the caller has reserved.
+// It gives up when ctx ends.
+func (p *Pool) dial(ctx context.Context, addr string) (*Client, error) {
+	var opts []ClientOption
+	if p.cfg.TLS != nil {
+		opts = append(opts, WithClientTLS(p.cfg.TLS))
+	}
+	if p.cfg.Codec != nil {
+		opts = append(opts, WithClientCodec(p.cfg.Codec))
+	}
+	c, err := newClient(ctx, addr, opts...)
+	if err != nil {
+		p.mu.Lock()
+		p.releaseLocked(p.addr(addr))
+		p.mu.Unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
+// addr returns the connections for an address. p.mu must be held.
+func (p *Pool) addr(addr string) *poolAddr {
+	a, ok := p.addrs[addr]
+	if !ok {
+		a = &poolAddr{}
+		p.addrs[addr] = a
+	}
+	return a
+}
+
+// maintain runs evict and fill every CheckInterval until the pool closes.
+func (p *Pool) maintain() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.evict()
+			p.fill()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// evict closes idle connections that are broken, or that have timed out
+// and are not needed for MinIdle.
+func (p *Pool) evict() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, a := range p.addrs {
+		keep := make([]idleClient, 0, len(a.idle))
+		// Walk from the most recently used connection, so that the
+		// oldest ones are the first to go.
+		for i := len(a.idle) - 1; i >= 0; i-- {
+			ic := a.idle[i]
+			expired := now.Sub(ic.since) > p.cfg.IdleTimeout && len(keep) >= p.cfg.MinIdle
+			if expired || !ic.c.healthy() {
+				ic.c.Close()
+				p.releaseLocked(a)
+				continue
+			}
+			keep = append(keep, ic)
+		}
+		// Restore the order: most recently used last.
+		for i, j := 0, len(keep)-1; i < j; i, j = i+1, j-1 {
+			keep[i], keep[j] = keep[j], keep[i]
+		}
+		a.idle = keep
+	}
+}
+
+// fill dials new connections until each address has MinIdle idle ones.
+func (p *Pool) fill() {
+	p.mu.Lock()
+	var addrs []string
+	for addr, a := range p.addrs {
+		for i := len(a.idle); i < p.cfg.MinIdle; i++ {
+			if p.cfg.MaxPerAddr > 0 && a.open >= p.cfg.MaxPerAddr {
+				break
+			}
+			a.open++
+			addrs = append(addrs, addr)
+		}
+	}
+	p.mu.Unlock()
+
+	// A connection that takes longer than a round to open is not worth
+	// waiting for.
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.CheckInterval)
+	defer cancel()
+	for _, addr := range addrs {
+		c, err := p.dial(ctx, addr)
+		if err != nil {
+			continue
+		}
+		p.put(addr, c)
+	}
+}
+
+// usable reports whether the Client's connection is still in sync.
+func (c *Client) usable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil
+}
+
+// healthy checks whether an idle Client's connection is still usable.
+func (c *Client) healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err == nil && (c.multiplexed || checkConn(c.conn, c.rw.Reader) == nil)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestPoolDialContext checks that a call gives up when its context ends,
+// even if the endpoint accepts the connection but never answers the
+// handshake.
+func TestPoolDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	p := NewPool(PoolConfig{})
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- p.Call(ctx, l.Addr().String(), "ECHO", nil, nil) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Call succeeded without a handshake")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call ignored the context while connecting")
+	}
+	(<-accepted).Close()
+}
+
+// startPoolServer serves an endpoint with a WAIT command, which signals
+// started and then blocks until release is closed.
+func startPoolServer(t *testing.T) (e *Endpoint, addr string, started, release chan struct{}) {
+	started = make(chan struct{}, 1)
+	release = make(chan struct{})
+	e = serverEndpoint(WithFraming())
+	e.AddHandler("WAIT", func(ctx context.Context, rw *bufio.ReadWriter) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Serve(l)
+	t.Cleanup(func() { e.Shutdown(context.Background()) })
+	return e, l.Addr().String(), started, release
+}
+
+// idleConns returns the number of idle connections to addr.
+func (p *Pool) idleConns(addr string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.addr(addr).idle)
+}
+
+// waitFor polls cond until it holds, or fails the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestPoolMaxPerAddr checks that a call waits while the only connection
+// is busy, and then gets that connection rather than a new one.
+func TestPoolMaxPerAddr(t *testing.T) {
+	e, addr, started, release := startPoolServer(t)
+	p := NewPool(PoolConfig{MaxPerAddr: 1})
+	defer p.Close()
+	ctx := context.Background()
+
+	first := make(chan error, 1)
+	go func() { first <- p.Call(ctx, addr, "WAIT", nil, nil) }()
+	<-started
+	second := make(chan error, 1)
+	go func() { second <- p.Call(ctx, addr, "STRING", "hello\n", nil) }()
+	select {
+	case err := <-second:
+		t.Fatalf("Second call returned %v while the connection was busy", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if n := e.nextConnID.Load(); n != 1 {
+		t.Fatalf("Endpoint got %d connections, want 1", n)
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	e, addr, _, _ := startPoolServer(t)
+	p := NewPool(PoolConfig{})
+	defer p.Close()
+	for i := 0; i < 3; i++ {
+		if err := p.Call(context.Background(), addr, "STRING", "hello\n", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := e.nextConnID.Load(); n != 1 {
+		t.Fatalf("Endpoint got %d connections, want 1", n)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	_, addr, _, _ := startPoolServer(t)
+	p := NewPool(PoolConfig{IdleTimeout: 10 * time.Millisecond, CheckInterval: 10 * time.Millisecond})
+	defer p.Close()
+	if err := p.Call(context.Background(), addr, "STRING", "hello\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the idle connection to be evicted", func() bool { return p.idleConns(addr) == 0 })
+}
+
+func TestPoolMinIdle(t *testing.T) {
+	e, addr, _, _ := startPoolServer(t)
+	p := NewPool(PoolConfig{MinIdle: 2, CheckInterval: 10 * time.Millisecond})
+	defer p.Close()
+	if err := p.Call(context.Background(), addr, "STRING", "hello\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a second idle connection", func() bool { return p.idleConns(addr) == 2 })
+	if n := e.nextConnID.Load(); n != 2 {
+		t.Fatalf("Endpoint got %d connections, want 2", n)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReconnectPolicy tells a Client how to redial after its connection broke.
+type ReconnectPolicy struct {
+	// InitialDelay is the upper bound of the first backoff delay.
+	// The default is 100ms.
+	InitialDelay time.Duration
+	// MaxDelay caps the backoff delay. The default is 10s.
+	MaxDelay time.Duration
+	// MaxAttempts is the number of dial attempts per reconnect.
+	// Zero means no limit.
+	MaxAttempts int
+	// MaxElapsed is the time after which a reconnect gives up.
+	// Zero means no limit. The caller's context can end it earlier.
+	MaxElapsed time.Duration
+	// Idempotent lists commands that are safe to send twice. If the
+	// connection breaks while such a request is in flight, the Client
+	// resends it once after reconnecting.
+	Idempotent []string
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithReconnect lets the Client redial broken connections according to p.
+// Without this option, a broken Client stays broken.
+func WithReconnect(p ReconnectPolicy) ClientOption {
+	return func(c *Client) {
+		if p.InitialDelay <= 0 {
+			p.InitialDelay = 100 * time.Millisecond
+		}
+		if p.MaxDelay <= 0 {
+			p.MaxDelay = 10 * time.Second
+		}
+		c.reconnect = &p
+		c.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
+// backoff returns a random delay between zero and the exponentially
+// growing limit for the given attempt ("full jitter"), so that many
+// clients do not redial in lockstep after a server restart.
+func (p *ReconnectPolicy) backoff(attempt int, rnd *rand.Rand) time.Duration {
+	limit := p.MaxDelay
+	if attempt < 32 {
+		if d := p.InitialDelay << uint(attempt); d > 0 && d < limit {
+			limit = d
+		}
+	}
+	return time.Duration(rnd.Int63n(int64(limit) + 1))
+}
+
+// idempotent reports whether cmd may be sent twice.
+func (p *ReconnectPolicy) idempotent(cmd string) bool {
+	for _, c := range p.Idempotent {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureConn makes sure that the Client has a usable connection, and
+// redials if necessary and allowed. c.mu must be held.
+func (c *Client) ensureConn(ctx context.Context) error {
+	if c.err == ErrClientClosed || c.reconnect == nil {
+		return c.err
+	}
+	if c.err == nil {
+		// A multiplexed connection is checked by the goroutine that
+		// reads the replies.
+		if c.multiplexed {
+			return nil
+		}
+		if err := checkConn(c.conn, c.rw.Reader); err == nil {
+			return nil
+		}
+		c.logger.Info("Connection is broken. Reconnect.", "addr", c.addr)
+		c.conn.Close()
+	}
+	return c.redial(ctx)
+}
+
+// redial dials the Client's address until it succeeds or the policy, the
+// context, or Close says to stop. c.mu must be held.
+func (c *Client) redial(ctx context.Context) error {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := c.connect(ctx)
+		if err == nil {
+			return nil
+		}
+		if c.reconnect.MaxAttempts > 0 && attempt+1 >= c.reconnect.MaxAttempts {
+			return errors.Wrapf(err, "Giving up after %d attempts", attempt+1)
+		}
+		delay := c.reconnect.backoff(attempt, c.rnd)
+		if c.reconnect.MaxElapsed > 0 && time.Since(start)+delay > c.reconnect.MaxElapsed {
+			return errors.Wrapf(err, "Giving up after %s", time.Since(start).Round(time.Millisecond))
+		}
+		c.logger.Warn("Reconnect failed", "addr", c.addr, "attempt", attempt+1, "retry_in", delay.Round(time.Millisecond), errorAttr(err))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-c.closing:
+			timer.Stop()
+			return ErrClientClosed
+		}
+	}
+}
+
+// checkConn tells whether an idle connection is still usable. An endpoint
+// never sends anything unasked, so if there is something to read - be it
+// data or EOF - the connection is out of sync or closed by the peer.
+func checkConn(conn net.Conn, r *bufio.Reader) error {
+	if r.Buffered() > 0 {
+		return errors.New("Unexpected data on idle connection")
+	}
+	conn.SetReadDeadline(time.Now())
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	if err == nil {
+		return errors.New("Unexpected data on idle connection")
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"testing"
+	"time"
+)
+
+// startBlocking serves an endpoint with a BLOCK command, which ignores
+// its context and only returns when release is closed. It sends a BLOCK
+// request and returns once the handler runs. The request's result
+// arrives on called.
+func startBlocking(t *testing.T) (e *Endpoint, release chan struct{}, called chan error) {
+	started := make(chan struct{})
+	release = make(chan struct{})
+	e = serverEndpoint(WithFraming())
+	e.AddHandler("BLOCK", func(ctx context.Context, rw *bufio.ReadWriter) error {
+		close(started)
+		<-release
+		_, err := rw.WriteString("done")
+		return err
+	})
+	l := NewMemListener()
+	go e.Serve(l)
+	c, err := NewClient("mem", WithDialer(l.Dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	called = make(chan error, 1)
+	go func() { called <- c.Call(context.Background(), "BLOCK", nil, nil) }()
+	<-started
+	return e, release, called
+}
+
+func TestShutdownWaits(t *testing.T) {
+	e, release, called := startBlocking(t)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- e.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v while a handler was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-called; err != nil {
+		t.Fatalf("Call failed during Shutdown: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	e, release, called := startBlocking(t)
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want context.DeadlineExceeded", err)
+	}
+	// The connection has been closed under the handler.
+	select {
+	case err := <-called:
+		if err == nil {
+			t.Fatal("Call succeeded on a closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not close the connection")
+	}
+}
+
+func TestListenContext(t *testing.T) {
+	e := serverEndpoint(WithFraming(), WithAddress("127.0.0.1:0"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listened := make(chan error, 1)
+	go func() { listened <- e.ListenContext(ctx) }()
+	for e.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	c, err := NewClient(e.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cancel()
+	select {
+	case err := <-listened:
+		if err != nil {
+			t.Fatalf("ListenContext returned %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenContext did not return after cancellation")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+## Error replies
+
+When an endpoint cannot process a command, it tells the client why before
+it moves on or hangs up. An error reply consists of a status code and a
+message.
+
+In newline mode, the error reply is a single line:
+
+    ERR <code> <message>\n
+
+The endpoint cannot know how much payload follows an unknown command, so it
+closes the connection after sending the error line.
+
+In framed mode, the error reply is a reply frame with FlagError set. The
+payload holds the status code as a two-byte big-endian number, followed by
+the message. The connection stays open.
+*/
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StatusCode tells what went wrong on the remote side.
+type StatusCode uint16
+
+// Status codes for error replies.
+const (
+	// StatusUnknownCommand means no handler is registered for the command.
+	StatusUnknownCommand StatusCode = iota + 1
+	// StatusMalformed means the request could not be parsed.
+	StatusMalformed
+	// StatusHandlerFailed means the handler could not process the request.
+	StatusHandlerFailed
+	// StatusTimeout means a read or write deadline expired. The endpoint
+	// closes the connection after sending this status.
+	StatusTimeout
+	// StatusUnsupported means the endpoint does not support a requested
+	// feature, such as a codec.
+	StatusUnsupported
+	// StatusIncompatible means the endpoint does not support the client's
+	// protocol version. The endpoint closes the connection after sending
+	// this status.
+	StatusIncompatible
+	// StatusInternal means the handler panicked.
+	StatusInternal
+	// StatusBusy means the endpoint has too many connections. It closes
+	// the connection after sending this status.
+	StatusBusy
+)
+
+func (c StatusCode) String() string {
+	switch c {
+	case StatusUnknownCommand:
+		return "unknown command"
+	case StatusMalformed:
+		return "malformed request"
+	case StatusHandlerFailed:
+		return "handler failed"
+	case StatusTimeout:
+		return "timeout"
+	case StatusUnsupported:
+		return "not supported"
+	case StatusIncompatible:
+		return "incompatible protocol version"
+	case StatusInternal:
+		return "internal error"
+	case StatusBusy:
+		return "busy"
+	}
+	return "status " + strconv.Itoa(int(c))
+}
+
+// closesConnection reports whether the endpoint closes a framed
+// connection after an error reply with this status.
+func (c StatusCode) closesConnection() bool {
+	return c == StatusTimeout || c == StatusIncompatible
+}
+
+// errorLinePrefix starts an error reply in newline mode.
+const errorLinePrefix = "ERR "
+
+// RemoteError is an error reply received from an endpoint.
+type RemoteError struct {
+	Code    StatusCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %d (%s): %s", e.Code, e.Code, e.Message)
+}
+
+// writeErrorLine sends an error reply in newline mode and flushes it.
+func writeErrorLine(w *bufio.Writer, code StatusCode, msg string) error {
+	// The message must not break the line.
+	msg = strings.Replace(msg, "\n", " ", -1)
+	_, err := fmt.Fprintf(w, "%s%d %s\n", errorLinePrefix, code, msg)
+	if err != nil {
+		return errors.Wrap(err, "Cannot write error reply")
+	}
+	return errors.Wrap(w.Flush(), "Flush failed.")
+}
+
+// ParseReplyLine checks a reply line read in newline mode. If the line is
+// an error reply, it returns a *RemoteError. Otherwise it returns the line
+// without the trailing newline.
+func ParseReplyLine(line string) (string, error) {
+	line = strings.TrimRight(line, "\n")
+	if !strings.HasPrefix(line, errorLinePrefix) {
+		return line, nil
+	}
+	fields := strings.SplitN(strings.TrimPrefix(line, errorLinePrefix), " ", 2)
+	code, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return line, errors.Wrapf(err, "Malformed error reply %q", line)
+	}
+	rerr := &RemoteError{Code: StatusCode(code)}
+	if len(fields) == 2 {
+		rerr.Message = fields[1]
+	}
+	return "", rerr
+}
+
+// errorFrame creates an error reply frame for the given command.
+func errorFrame(cmd string, code StatusCode, msg string) Frame {
+	payload := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return Frame{
+		Flags:   FlagReply | FlagError,
+		Command: cmd,
+		Payload: append(payload, msg...),
+	}
+}
+
+// Err returns a *RemoteError if f is an error reply, and nil otherwise.
+func (f Frame) Err() error {
+	if f.Flags&FlagError == 0 {
+		return nil
+	}
+	if len(f.Payload) < 2 {
+		return &RemoteError{Code: StatusMalformed, Message: "truncated error reply"}
+	}
+	return &RemoteError{
+		Code:    StatusCode(binary.BigEndian.Uint16(f.Payload)),
+		Message: string(f.Payload[2:]),
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+/*
+## Persistent encoders and decoders
+
+A GOB stream is self-describing: before the first value of a type, the
+encoder sends a description of that type, and the decoder remembers it.
+Creating a new encoder and decoder for every message therefore sends and
+parses the type descriptions again and again. Worse, a decoder that sees a
+type description twice - because the sender used two encoders on the same
+stream - fails with "duplicate type received".
+
+So the endpoint and the Client keep one encoder and one decoder per
+connection. Handlers get them from RequestDecoder and ReplyEncoder.
+Concurrent requests (see mux.go) cannot share a stream, as nobody knows
+in which order they are decoded. Their payloads are encoded separately.
+
+In framed mode, a reply frame may be dropped - for an error reply or a
+one-way request - and with it the type descriptions that the encoder has
+written. To keep both sides in sync, frames can carry FlagReset:
+
+* A reply with FlagReset was written by a new encoder. The Client starts a
+  new decoder before reading it.
+* A request with FlagReset tells the endpoint that the Client has started
+  over in both directions. The endpoint then starts a new decoder and a new
+  encoder, too.
+
+The Client starts over on a new connection, after an error reply, and
+after a one-way request, which the endpoint may not have decoded. The
+endpoint starts a new encoder after an error or a one-way request.
+
+GOB can only transmit a value in an interface-typed field if the concrete
+type is registered on both sides. RegisterTypes does that.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+
+	"github.com/pkg/errors"
+)
+
+// RegisterTypes registers the concrete types of the given values with
+// GOB, so that they can travel in interface-typed fields. Both sides of
+// a connection must register the same types, usually in an init function.
+func RegisterTypes(values ...interface{}) {
+	for _, v := range values {
+		gob.Register(v)
+	}
+}
+
+// streams holds the persistent decoder and encoder of an endpoint
+// connection, along with what they were created for. Whenever a handler
+// asks for a different codec or buffer, the stream is replaced.
+type streams struct {
+	dec      Decoder
+	decCodec string
+	decFrom  *bufio.Reader
+
+	enc      Encoder
+	encCodec string
+	encTo    *bufio.Writer
+	// fresh is set when a new encoder has been created and the client
+	// has not been told yet.
+	fresh bool
+}
+
+// RequestDecoder returns the connection's decoder for reading the
+// request payload from rw with the command's codec. For concurrent
+// requests, and outside of an endpoint connection, it returns a new
+// decoder.
+func RequestDecoder(ctx context.Context, rw *bufio.ReadWriter) Decoder {
+	codec := CodecFromContext(ctx)
+	s := sessionFromContext(ctx)
+	if s == nil || concurrent(ctx) {
+		return codec.NewDecoder(rw)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &s.streams
+	if st.dec == nil || st.decCodec != codec.Name() || st.decFrom != rw.Reader {
+		st.dec = codec.NewDecoder(rw.Reader)
+		st.decCodec = codec.Name()
+		st.decFrom = rw.Reader
+	}
+	return st.dec
+}
+
+// ReplyEncoder returns the connection's encoder for writing the reply to
+// rw with the command's codec. For concurrent requests, and outside of
+// an endpoint connection, it returns a new encoder.
+func ReplyEncoder(ctx context.Context, rw *bufio.ReadWriter) Encoder {
+	codec := CodecFromContext(ctx)
+	s := sessionFromContext(ctx)
+	if s == nil || concurrent(ctx) {
+		return codec.NewEncoder(rw)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &s.streams
+	if st.enc == nil || st.encCodec != codec.Name() || st.encTo != rw.Writer {
+		st.enc = codec.NewEncoder(rw.Writer)
+		st.encCodec = codec.Name()
+		st.encTo = rw.Writer
+		st.fresh = true
+	}
+	return st.enc
+}
+
+// concurrent reports whether the handler serves a request with an ID.
+func concurrent(ctx context.Context) bool {
+	info, ok := RequestInfoFromContext(ctx)
+	return ok && info.ID != 0
+}
+
+// resetStreams makes the next request start with a new decoder and
+// encoder.
+func (s *session) resetStreams() {
+	s.mu.Lock()
+	s.streams = streams{}
+	s.mu.Unlock()
+}
+
+// resetEncoder makes the next reply start with a new encoder.
+func (s *session) resetEncoder() {
+	s.mu.Lock()
+	s.streams.enc = nil
+	s.streams.fresh = false
+	s.mu.Unlock()
+}
+
+// takeFresh reports whether a new encoder has written to the current
+// reply, and clears the mark.
+func (s *session) takeFresh() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fresh := s.streams.fresh
+	s.streams.fresh = false
+	return fresh
+}
+
+// clientStreams holds the persistent encoder and decoder of a Client's
+// connection. The encoder writes into buf, from where each request
+// payload is taken; the decoder reads from src, which is reset to each
+// reply payload.
+type clientStreams struct {
+	buf bytes.Buffer
+	enc Encoder
+	src bytes.Reader
+	dec Decoder
+	// reset is set when the next request must carry FlagReset.
+	reset bool
+}
+
+// resetStreams starts over with a new encoder and decoder. c.mu must be
+// held.
+func (c *Client) resetStreams() {
+	c.streams.enc = nil
+	c.streams.dec = nil
+	c.streams.reset = true
+}
+
+// encode encodes v with the connection's encoder, or with a new one if
+// the Client is multiplexed. c.mu must be held.
+func (c *Client) encode(v interface{}) ([]byte, error) {
+	st := &c.streams
+	st.buf.Reset()
+	if st.enc == nil || c.multiplexed {
+		st.enc = c.getCodec().NewEncoder(&st.buf)
+	}
+	if err := st.enc.Encode(v); err != nil {
+		return nil, errors.Wrapf(err, "Encode failed for %T", v)
+	}
+	return append([]byte(nil), st.buf.Bytes()...), nil
+}
+
+// decode decodes a reply payload into v with the connection's decoder.
+// c.mu must be held, unless the Client is multiplexed, which decodes
+// each reply with a new decoder.
+func (c *Client) decode(data []byte, v interface{}) error {
+	if c.multiplexed {
+		dec := c.getCodec().NewDecoder(bytes.NewReader(data))
+		return errors.Wrapf(dec.Decode(v), "Decode failed for %T", v)
+	}
+	st := &c.streams
+	st.src.Reset(data)
+	if st.dec == nil {
+		st.dec = c.getCodec().NewDecoder(&st.src)
+	}
+	return errors.Wrapf(st.dec.Decode(v), "Decode failed for %T", v)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+// BenchmarkGobFreshStreams encodes and decodes each value with a new
+// encoder and decoder, as each message carried its own type information.
+func BenchmarkGobFreshStreams(b *testing.B) {
+	data := testData()
+	var buf bytes.Buffer
+	var total int
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := (GobCodec{}).NewEncoder(&buf).Encode(data); err != nil {
+			b.Fatal(err)
+		}
+		total += buf.Len()
+		var out complexData
+		if err := (GobCodec{}).NewDecoder(&buf).Decode(&out); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(total)/float64(b.N), "wirebytes/op")
+}
+
+// BenchmarkGobPersistentStreams encodes and decodes all values with one
+// encoder and decoder, which send the type information only once.
+func BenchmarkGobPersistentStreams(b *testing.B) {
+	data := testData()
+	var buf bytes.Buffer
+	enc := (GobCodec{}).NewEncoder(&buf)
+	dec := (GobCodec{}).NewDecoder(&buf)
+	var total int
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(data); err != nil {
+			b.Fatal(err)
+		}
+		total += buf.Len()
+		var out complexData
+		if err := dec.Decode(&out); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(total)/float64(b.N), "wirebytes/op")
+}
+
+// BenchmarkClientEcho measures round trips through a framed endpoint,
+// which keeps the streams of each connection.
+func BenchmarkClientEcho(b *testing.B) {
+	e := NewEndpoint(WithFraming())
+	Handle(e, "ECHO", handleEcho)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go e.Serve(ln)
+	defer e.Shutdown(context.Background())
+
+	c, err := NewClient(ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	data := testData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Call[complexData, complexData](ctx, c, "ECHO", data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestClientSendUnknown checks that a one-way request that the endpoint
+// never decodes does not take the type descriptions with it.
+func TestClientSendUnknown(t *testing.T) {
+	c := startMem(t)
+	ctx := context.Background()
+	if err := c.Send(ctx, "NOPE", testData()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Call[complexData, complexData](ctx, c, "ECHO", testData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Echo: " + testData().S; got.S != want {
+		t.Fatalf("Got %q, want %q", got.S, want)
+	}
+}
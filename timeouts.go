@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errorReplyTimeout limits the time for sending an error reply before
+// closing a connection.
+const errorReplyTimeout = time.Second
+
+// WithIdleTimeout closes connections that send no new command for the
+// given time. The default is to wait forever.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(e *Endpoint) {
+		e.idleTimeout = d
+	}
+}
+
+// WithReadTimeout limits the time that a command may take to send its
+// payload, counted from the end of the command name. The default is no
+// limit.
+func WithReadTimeout(d time.Duration) Option {
+	return func(e *Endpoint) {
+		e.readTimeout = d
+	}
+}
+
+// WithWriteTimeout limits the time for sending a reply. The default is
+// no limit.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(e *Endpoint) {
+		e.writeTimeout = d
+	}
+}
+
+// setIdleDeadline sets the read deadline for waiting for the next command.
+func (e *Endpoint) setIdleDeadline(conn net.Conn) {
+	conn.SetReadDeadline(deadline(e.idleTimeout))
+}
+
+// setCommandDeadline replaces the idle deadline with the deadline for
+// reading the current command's payload.
+func (e *Endpoint) setCommandDeadline(conn net.Conn) {
+	conn.SetReadDeadline(deadline(e.readTimeout))
+}
+
+// setReplyDeadline sets the write deadline for the reply to the current
+// command.
+func (e *Endpoint) setReplyDeadline(conn net.Conn) {
+	conn.SetWriteDeadline(deadline(e.writeTimeout))
+}
+
+// deadline turns a timeout into a deadline. A zero timeout means no
+// deadline.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// isTimeout reports whether err was caused by an expired deadline.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,161 @@
+package main
+
+/*
+## TLS
+
+To leave the local machine, the data should be encrypted. The `crypto/tls`
+package wraps any listener or connection, so the protocol code does not
+change at all. With a client CA pool, the endpoint also requires and
+verifies client certificates (mutual TLS), and handlers can see who is
+calling via RequestInfo.
+*/
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithTLS lets the endpoint accept TLS connections only. See
+// ServerTLSConfig for a simple configuration.
+func WithTLS(cfg *tls.Config) Option {
+	return func(e *Endpoint) {
+		e.tlsConfig = cfg
+	}
+}
+
+// WithClientTLS lets the Client connect via TLS. See ClientTLSConfig for
+// a simple configuration.
+func WithClientTLS(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+	}
+}
+
+// ServerTLSConfig creates an endpoint configuration that presents cert.
+// If clientCAs is not nil, clients must present a certificate signed
+// by one of these CAs.
+func ServerTLSConfig(cert tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg
+}
+
+// ClientTLSConfig creates a client configuration that trusts the given
+// root CAs, or the system roots if rootCAs is nil. If cert is not nil,
+// the client presents it to endpoints that require client certificates.
+func ClientTLSConfig(rootCAs *x509.CertPool, cert *tls.Certificate) *tls.Config {
+	cfg := &tls.Config{
+		RootCAs:    rootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg
+}
+
+// OpenTLS works like Open but connects via TLS.
+func OpenTLS(addr string, cfg *tls.Config) (*bufio.ReadWriter, error) {
+	_, rw, err := open(addr, cfg)
+	return rw, err
+}
+
+// GenerateDevCert creates a self-signed certificate and its private key,
+// both PEM-encoded, for the given host names and IP addresses. The
+// certificate is valid for one year, for both server and client
+// authentication, and can act as its own CA. It is meant for development
+// and tests; do not use it in production.
+func GenerateDevCert(hosts ...string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Cannot generate key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Cannot generate serial number")
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "networking dev cert", Organization: []string{"networking"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		tmpl.Subject.CommonName = hosts[0]
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Cannot create certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Cannot marshal private key")
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// LoadCertPool reads PEM-encoded CA certificates from a file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot read CA file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("No certificates found in " + file)
+	}
+	return pool, nil
+}
+
+// writeDevCert generates a dev certificate for localhost and writes it
+// to prefix.crt and prefix.key.
+func writeDevCert(prefix string) error {
+	certPEM, keyPEM, err := GenerateDevCert("localhost", "127.0.0.1", "::1")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(prefix+".crt", certPEM, 0644); err != nil {
+		return errors.Wrap(err, "Cannot write certificate")
+	}
+	return errors.Wrap(ioutil.WriteFile(prefix+".key", keyPEM, 0600), "Cannot write key")
+}
+
+// PeerCertificate returns the verified certificate of the remote side,
+// or nil if the connection is not TLS or the peer sent no certificate.
+func (ri *RequestInfo) PeerCertificate() *x509.Certificate {
+	if ri.TLS == nil || len(ri.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return ri.TLS.PeerCertificates[0]
+}
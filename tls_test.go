@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// devCert generates a dev certificate and returns it along with a pool
+// that trusts it.
+func devCert(t *testing.T, hosts ...string) (tls.Certificate, *x509.CertPool) {
+	certPEM, keyPEM, err := GenerateDevCert(hosts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("No certificate in the PEM data")
+	}
+	return cert, pool
+}
+
+func TestMutualTLS(t *testing.T) {
+	serverCert, serverPool := devCert(t, "127.0.0.1")
+	clientCert, clientPool := devCert(t, "client")
+
+	e := serverEndpoint(WithFraming(), WithTLS(ServerTLSConfig(serverCert, clientPool)))
+	e.AddHandler("WHO", func(ctx context.Context, rw *bufio.ReadWriter) error {
+		info, _ := RequestInfoFromContext(ctx)
+		cert := info.PeerCertificate()
+		if cert == nil {
+			return errors.New("no client certificate")
+		}
+		_, err := rw.WriteString(cert.Subject.CommonName)
+		return err
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e.Serve(l)
+	defer e.Shutdown(context.Background())
+	addr := l.Addr().String()
+
+	c, err := NewClient(addr, WithClientTLS(ClientTLSConfig(serverPool, &clientCert)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var who string
+	if err := c.Call(context.Background(), "WHO", nil, &who); err != nil {
+		t.Fatal(err)
+	}
+	if who != "client" {
+		t.Fatalf("Got peer certificate for %q, want %q", who, "client")
+	}
+
+	if c, err := NewClient(addr, WithClientTLS(ClientTLSConfig(serverPool, nil))); err == nil {
+		c.Close()
+		t.Fatal("Connected without a client certificate")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+/*
+## Typed handlers
+
+Most handlers follow the same steps as handleGob: get a decoder, decode
+the request into a variable of a known type, handle decoding errors, do the
+actual work, and encode the reply. Handle does all but the actual work for
+any request and reply type, and Call is its counterpart on the client side.
+*/
+
+import (
+	"bufio"
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// Handle registers a handler function that receives a decoded request of
+// type Req and returns a reply of type Resp. Both are encoded with the
+// codec in effect for the command (see codec.go). A request that cannot
+// be decoded is answered with StatusMalformed, and an error from f is
+// sent back as an error reply.
+func Handle[Req, Resp any](e *Endpoint, name string, f func(context.Context, Req) (Resp, error), opts ...HandlerOption) {
+	// Tell HELP about the types, unless opts say otherwise.
+	types := withTypes(reflect.TypeOf((*Req)(nil)).Elem(), reflect.TypeOf((*Resp)(nil)).Elem())
+	opts = append([]HandlerOption{types}, opts...)
+	e.AddHandler(name, func(ctx context.Context, rw *bufio.ReadWriter) error {
+		var req Req
+		if err := RequestDecoder(ctx, rw).Decode(&req); err != nil {
+			if isTimeout(err) {
+				return errors.Wrapf(err, "Timeout decoding %T", req)
+			}
+			return &RemoteError{Code: StatusMalformed, Message: "cannot decode request: " + err.Error()}
+		}
+		resp, err := f(ctx, req)
+		if err != nil {
+			return err
+		}
+		if err := ReplyEncoder(ctx, rw).Encode(resp); err != nil {
+			return errors.Wrapf(err, "Encode failed for %T", resp)
+		}
+		return errors.Wrap(rw.Flush(), "Flush failed.")
+	}, opts...)
+}
+
+// Call sends a request of type Req to a command registered with Handle
+// and decodes the reply into a Resp. Unlike Client.Call, it always uses
+// the Client's codec, even for strings and byte slices.
+func Call[Req, Resp any](ctx context.Context, c *Client, cmd string, req Req) (Resp, error) {
+	var resp Resp
+	err := c.roundTrip(ctx, cmd, 0,
+		func() ([]byte, error) { return c.encode(req) },
+		func(reply []byte) error { return c.decode(reply, &resp) })
+	return resp, err
+}
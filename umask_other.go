@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// withUmask calls f. There is no umask outside of Unix.
+func withUmask(mask int, f func() error) error {
+	return f()
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the endpoint's changes to the umask.
+var umaskMu sync.Mutex
+
+// withUmask calls f with the process's umask set to mask. The umask
+// applies to the whole process, so files that other goroutines create in
+// the meantime get the more restrictive permissions, too.
+func withUmask(mask int, f func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
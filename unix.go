@@ -0,0 +1,131 @@
+package main
+
+/*
+## Unix sockets
+
+Processes on the same host need not go through the TCP stack. A Unix
+domain socket is addressed by a file path, and the file's permissions
+decide who may connect. On Linux, the endpoint can also ask the kernel
+who is on the other side: the peer's process ID, user ID, and group ID
+are in RequestInfo.Cred.
+
+An endpoint listens on a Unix socket WithNetwork("unix") and a path as
+its address. On Linux, a path that starts with "@" is a name in the
+abstract namespace, which exists only while the endpoint listens and has
+no file and no permissions.
+
+WithSocketMode restricts who may connect. Changing the permissions after
+the socket file exists would leave a gap in which anyone could connect, so
+the endpoint sets the process's umask while it creates the socket, and
+the file never has more permissions than the mode allows. (Outside of
+Unix, there is no umask, and the permissions are only set afterwards.)
+
+If the endpoint was killed, the socket file stays behind, and listening
+on the path again would fail. So before listening, Listen removes the
+file - but only if it is a socket and nobody accepts connections on it.
+
+Clients dial a Unix socket if the address starts with "unix:", "/", or
+"@", as in:
+
+    NewClient("unix:/tmp/networking.sock")
+    NewClient("/tmp/networking.sock")
+    NewClient("@networking")
+*/
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// staleDialTimeout is how long Listen waits for an existing socket to
+// accept a connection before it considers the socket stale.
+const staleDialTimeout = 100 * time.Millisecond
+
+// WithSocketMode sets the file permissions of a Unix socket, for example
+// 0660 to let only the owner and the group connect. The default leaves
+// them to the process's umask.
+func WithSocketMode(mode os.FileMode) Option {
+	return func(e *Endpoint) {
+		e.socketMode = mode
+	}
+}
+
+// PeerCred identifies the process on the other side of a Unix socket.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// splitNetwork returns the network and address to dial for addr. An
+// address that starts with "unix:", "/", or "@" is a Unix socket; any
+// other address is a TCP host and port.
+func splitNetwork(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	case strings.HasPrefix(addr, "/"), strings.HasPrefix(addr, "@"):
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// isAbstract reports whether a Unix socket address is in the abstract
+// namespace, which has no file.
+func isAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket removes the socket file at path if no one listens on
+// it anymore. It fails if the file is not a socket or still in use.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Cannot check "+path)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, staleDialTimeout)
+	if err == nil {
+		conn.Close()
+		return errors.Errorf("%s is in use by another endpoint", path)
+	}
+	return errors.Wrap(os.Remove(path), "Cannot remove stale socket "+path)
+}
+
+// listenUnix listens on a Unix socket, after cleaning up a stale socket
+// file, and creates the socket with the endpoint's socket mode.
+func (e *Endpoint) listenUnix() (net.Listener, error) {
+	path := e.address
+	if isAbstract(path) {
+		return net.Listen("unix", path)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	if e.socketMode == 0 {
+		return net.Listen("unix", path)
+	}
+	var listener net.Listener
+	err := withUmask(int(^e.socketMode&os.ModePerm), func() (err error) {
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Outside of Unix, this is what sets the mode.
+	if err := os.Chmod(path, e.socketMode); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "Cannot set the permissions of "+path)
+	}
+	return listener, nil
+}
@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// umask returns the process's umask.
+func umask() int {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return mask
+}
+
+func TestWithUmask(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	before := umask()
+	if err := withUmask(0077, func() error { return os.WriteFile(path, nil, 0666) }); err != nil {
+		t.Fatal(err)
+	}
+	if after := umask(); after != before {
+		t.Fatalf("Umask is %o after withUmask, want %o", after, before)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Fatalf("Got mode %o, want 600", mode)
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	e := serverEndpoint(WithNetwork("unix"), WithAddress(path), WithSocketMode(0600))
+	l, err := e.listenUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Fatalf("Got mode %o, want 600", mode)
+	}
+}